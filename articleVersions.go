@@ -0,0 +1,182 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var articleVersionsBucket = []byte("articleVersions")
+
+// articleVersions remembers the lastModified of the latest version published for each article, to recognise stale
+// versions arriving late. It keeps the most recently published articles only, up to size of them. When a bolt database
+// is given, every change is written to it too and it's loaded on start, so the protection survives restarts.
+type articleVersions struct {
+	sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	recency *list.List
+	db      *bolt.DB
+}
+
+type articleVersion struct {
+	uuid         string
+	lastModified time.Time
+}
+
+// storedArticleVersion is how a version is kept in the bolt database. Sequence grows with every version published, to
+// load the articles in the order they were published. Versions stored as a bare lastModified have none and come first.
+type storedArticleVersion struct {
+	LastModified time.Time `json:"lastModified"`
+	Sequence     uint64    `json:"sequence"`
+}
+
+func newArticleVersions(size int) *articleVersions {
+	return &articleVersions{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		recency: list.New(),
+	}
+}
+
+// openArticleVersions returns the versions stored in the bolt database at path, creating it when needed. They're
+// loaded from the least to the most recently published, and the least recent ones beyond size are deleted, all in one
+// transaction.
+func openArticleVersions(size int, path string) (*articleVersions, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't open article versions database path=%v. %v", path, err)
+	}
+	v := newArticleVersions(size)
+	v.db = db
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(articleVersionsBucket)
+		if err != nil {
+			return err
+		}
+		type loadedVersion struct {
+			version  *articleVersion
+			sequence uint64
+		}
+		var loaded []loadedVersion
+		err = bucket.ForEach(func(uuid []byte, value []byte) error {
+			stored, err := parseStoredArticleVersion(value)
+			if err != nil {
+				logEvent(storeEvent, "").WithFields(logrus.Fields{uuidField: string(uuid), "value": string(value)}).WithError(err).Warn("Skipping stored article version that couldn't be parsed.")
+				return nil
+			}
+			loaded = append(loaded, loadedVersion{version: &articleVersion{uuid: string(uuid), lastModified: stored.LastModified}, sequence: stored.Sequence})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(loaded, func(i, j int) bool { return loaded[i].sequence < loaded[j].sequence })
+		for _, l := range loaded {
+			v.entries[l.version.uuid] = v.recency.PushFront(l.version)
+		}
+		for _, uuid := range v.evict() {
+			if err := bucket.Delete([]byte(uuid)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Couldn't load article versions path=%v. %v", path, err)
+	}
+	return v, nil
+}
+
+func parseStoredArticleVersion(value []byte) (storedArticleVersion, error) {
+	var stored storedArticleVersion
+	if err := json.Unmarshal(value, &stored); err == nil {
+		return stored, nil
+	}
+	lastModified, err := time.Parse(time.RFC3339Nano, string(value))
+	return storedArticleVersion{LastModified: lastModified}, err
+}
+
+// isStale reports whether lastModified is older than the latest version published for the article. A version as
+// old as the latest one isn't stale, as it's the same one consumed again.
+func (v *articleVersions) isStale(uuid string, lastModified time.Time) (bool, time.Time) {
+	v.Lock()
+	defer v.Unlock()
+	element, found := v.entries[uuid]
+	if !found {
+		return false, time.Time{}
+	}
+	latest := element.Value.(*articleVersion).lastModified
+	return lastModified.Before(latest), latest
+}
+
+// published records lastModified as the latest version of the article, unless a newer one was already published.
+func (v *articleVersions) published(uuid string, lastModified time.Time) {
+	v.Lock()
+	defer v.Unlock()
+	if element, found := v.entries[uuid]; found && lastModified.Before(element.Value.(*articleVersion).lastModified) {
+		return
+	}
+	v.put(uuid, lastModified)
+}
+
+func (v *articleVersions) put(uuid string, lastModified time.Time) {
+	if element, found := v.entries[uuid]; found {
+		element.Value.(*articleVersion).lastModified = lastModified
+		v.recency.MoveToFront(element)
+	} else {
+		v.entries[uuid] = v.recency.PushFront(&articleVersion{uuid: uuid, lastModified: lastModified})
+	}
+	evicted := v.evict()
+	if v.db == nil {
+		return
+	}
+	err := v.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(articleVersionsBucket)
+		for _, uuid := range evicted {
+			if err := bucket.Delete([]byte(uuid)); err != nil {
+				return err
+			}
+		}
+		if _, found := v.entries[uuid]; !found {
+			return nil
+		}
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		stored, err := json.Marshal(storedArticleVersion{LastModified: lastModified, Sequence: sequence})
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(uuid), stored)
+	})
+	if err != nil {
+		logEvent(storeEvent, "").WithField(uuidField, uuid).WithError(err).Warn("Couldn't store article version.")
+	}
+}
+
+// evict drops the least recently published articles beyond size, and returns their uuids.
+func (v *articleVersions) evict() []string {
+	var evicted []string
+	for v.recency.Len() > v.size {
+		oldest := v.recency.Remove(v.recency.Back()).(*articleVersion)
+		delete(v.entries, oldest.uuid)
+		evicted = append(evicted, oldest.uuid)
+	}
+	return evicted
+}
+
+func (v *articleVersions) close() error {
+	if v.db == nil {
+		return nil
+	}
+	return v.db.Close()
+}
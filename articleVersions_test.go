@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+var versionTime = time.Date(2017, 5, 15, 15, 54, 32, 166000000, time.UTC)
+
+func TestArticleVersions_StaleOnlyWhenOlder(t *testing.T) {
+	v := newArticleVersions(10)
+	stale, _ := v.isStale("a", versionTime)
+	assert.False(t, stale, "Unknown articles are never stale")
+
+	v.published("a", versionTime)
+	stale, latest := v.isStale("a", versionTime.Add(-time.Millisecond))
+	assert.True(t, stale)
+	assert.Equal(t, versionTime, latest)
+	stale, _ = v.isStale("a", versionTime)
+	assert.False(t, stale)
+
+	v.published("a", versionTime.Add(-time.Hour))
+	_, latest = v.isStale("a", versionTime)
+	assert.Equal(t, versionTime, latest, "An older version shouldn't replace the latest one")
+}
+
+func TestArticleVersions_EvictsLeastRecentlyPublished(t *testing.T) {
+	v := newArticleVersions(2)
+	v.published("a", versionTime)
+	v.published("b", versionTime)
+	v.published("a", versionTime.Add(time.Second))
+	v.published("c", versionTime)
+
+	stale, _ := v.isStale("b", versionTime.Add(-time.Hour))
+	assert.False(t, stale, "b was evicted")
+	stale, _ = v.isStale("a", versionTime)
+	assert.True(t, stale)
+	stale, _ = v.isStale("c", versionTime.Add(-time.Hour))
+	assert.True(t, stale)
+}
+
+func TestArticleVersions_PersistsAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "articleVersions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "versions.db")
+
+	v, err := openArticleVersions(2, path)
+	assert.NoError(t, err)
+	v.published("a", versionTime)
+	v.published("b", versionTime)
+	v.published("c", versionTime)
+	assert.NoError(t, v.close())
+
+	v, err = openArticleVersions(2, path)
+	assert.NoError(t, err)
+	defer v.close()
+	stale, latest := v.isStale("c", versionTime.Add(-time.Hour))
+	assert.True(t, stale)
+	assert.Equal(t, versionTime, latest.UTC())
+	stale, _ = v.isStale("a", versionTime.Add(-time.Hour))
+	assert.False(t, stale, "Evicted articles should be deleted from the store too")
+}
+
+func TestArticleVersions_RestartKeepsRecencyWithSmallerSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "articleVersions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "versions.db")
+
+	v, err := openArticleVersions(3, path)
+	assert.NoError(t, err)
+	v.published("a", versionTime)
+	v.published("c", versionTime)
+	v.published("b", versionTime)
+	v.published("a", versionTime.Add(time.Second))
+	assert.NoError(t, v.close())
+
+	v, err = openArticleVersions(2, path)
+	assert.NoError(t, err)
+	stale, _ := v.isStale("c", versionTime.Add(-time.Hour))
+	assert.False(t, stale, "c was the least recently published, whatever the order of the uuids")
+	stale, _ = v.isStale("a", versionTime)
+	assert.True(t, stale)
+	stale, _ = v.isStale("b", versionTime.Add(-time.Hour))
+	assert.True(t, stale)
+	assert.NoError(t, v.close())
+
+	v, err = openArticleVersions(3, path)
+	assert.NoError(t, err)
+	defer v.close()
+	stale, _ = v.isStale("c", versionTime.Add(-time.Hour))
+	assert.False(t, stale, "The evicted article should be deleted from the store")
+}
+
+func TestArticleVersions_LoadsVersionsStoredWithoutSequence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "articleVersions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "versions.db")
+	db, err := bolt.Open(path, 0600, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(articleVersionsBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("a"), []byte(versionTime.Format(time.RFC3339Nano)))
+	}))
+	assert.NoError(t, db.Close())
+
+	v, err := openArticleVersions(2, path)
+	assert.NoError(t, err)
+	defer v.close()
+	stale, latest := v.isStale("a", versionTime.Add(-time.Hour))
+	assert.True(t, stale)
+	assert.Equal(t, versionTime, latest.UTC())
+}
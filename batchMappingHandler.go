@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	trans "github.com/Financial-Times/transactionid-utils-go"
+)
+
+// batchMappingHandler maps many native articles in one request, given as a JSON array or as JSON lines. It writes one
+// JSON line per article, in the order of the request, each flushed as soon as it and the ones before it are mapped.
+type batchMappingHandler struct {
+	defaultHTTPMappingHandler
+	maxBytes    int64
+	concurrency int
+}
+
+// batchImageSets is the line written for an article that was mapped. Index is its position in the request.
+type batchImageSets struct {
+	Index     int            `json:"index"`
+	UUID      string         `json:"uuid"`
+	ImageSets []JSONImageSet `json:"imageSets"`
+}
+
+// batchError is the line written for an article that couldn't be mapped. The uuid is missing when it couldn't be read.
+type batchError struct {
+	Index int          `json:"index"`
+	UUID  string       `json:"uuid,omitempty"`
+	Error ErrorMessage `json:"error"`
+}
+
+func newBatchMappingHandler(messageToNativeMapper MessageToNativeMapper, imageSetMapper ImageSetMapper, maxBytes int64, concurrency int) *batchMappingHandler {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &batchMappingHandler{
+		defaultHTTPMappingHandler: defaultHTTPMappingHandler{
+			messageToNativeMapper: messageToNativeMapper,
+			imageSetMapper:        imageSetMapper,
+		},
+		maxBytes:    maxBytes,
+		concurrency: concurrency,
+	}
+}
+
+func (h *batchMappingHandler) handle(w http.ResponseWriter, r *http.Request) {
+	tid := trans.GetTransactionIDFromRequest(r)
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Header().Add(trans.TransactionIDHeader, tid)
+	defer closeRequestBody(r)
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, h.maxBytes+1))
+	if err != nil {
+		writeError(w, newInternalError(requestStage, fmt.Errorf("Couldn't read from request body. %v", err)), tid)
+		return
+	}
+	if int64(len(body)) > h.maxBytes {
+		writeError(w, newMappingError(batchTooLargeCode, requestStage, "", fmt.Errorf("Batch is larger than the limit of %v bytes.", h.maxBytes)), tid)
+		return
+	}
+	articles, err := splitBatch(body)
+	if err != nil {
+		writeError(w, newMappingError(invalidRequestCode, requestStage, "", fmt.Errorf("Couldn't read batch as a JSON array of articles. %v", err)), tid)
+		return
+	}
+	logEvent(requestEvent, tid).WithField("count", len(articles)).Info("Mapping batch of articles.")
+
+	w.Header().Set("Content-Type", "application/x-ndjson;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	writeErr := error(nil)
+	for result := range h.mapConcurrently(r.Context(), articles, tid) {
+		var line interface{}
+		select {
+		case line = <-result:
+		case <-r.Context().Done():
+			logEvent(requestEvent, tid).WithError(r.Context().Err()).Warn("Batch request ended, stopped mapping the rest of the batch.")
+			return
+		}
+		if writeErr != nil {
+			continue
+		}
+		writeErr = encoder.Encode(line)
+		if writeErr != nil {
+			logEvent(requestEvent, tid).WithError(writeErr).Warn("Couldn't write batch result, mapping the rest of the batch without writing it.")
+			continue
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// mapConcurrently maps up to h.concurrency articles at once. It returns the results in the order of the articles, each
+// once it's ready. No more articles are mapped once the context is done.
+func (h *batchMappingHandler) mapConcurrently(ctx context.Context, articles []json.RawMessage, tid string) <-chan chan interface{} {
+	results := make(chan chan interface{}, h.concurrency)
+	running := make(chan struct{}, h.concurrency)
+	go func() {
+		defer close(results)
+		for i, article := range articles {
+			result := make(chan interface{}, 1)
+			select {
+			case running <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case results <- result:
+			case <-ctx.Done():
+				<-running
+				return
+			}
+			go func(i int, article json.RawMessage) {
+				defer func() { <-running }()
+				if ctx.Err() != nil {
+					return
+				}
+				result <- h.mapArticle(i, article, tid)
+			}(i, article)
+		}
+	}()
+	return results
+}
+
+func (h *batchMappingHandler) mapArticle(index int, article json.RawMessage, tid string) interface{} {
+	native, err := h.messageToNativeMapper.Map(article)
+	if err != nil {
+		return batchError{Index: index, Error: newHTTPErrorMessage(newMappingError(invalidNativeJSONCode, nativeStage, "", fmt.Errorf("Error mapping native message. %v", err)), tid)}
+	}
+	imageSets, err := h.imageSetMapper.Map(native, time.Now().UTC().Format(uppDateFormat), tid)
+	if err != nil {
+		return batchError{Index: index, UUID: native.Uuid, Error: newHTTPErrorMessage(asMappingError(err, mappingFailedCode, imageSetStage).prefixed("Error mapping the given content."), tid)}
+	}
+	if imageSets == nil {
+		imageSets = []JSONImageSet{}
+	}
+	return batchImageSets{Index: index, UUID: native.Uuid, ImageSets: imageSets}
+}
+
+// splitBatch returns the articles of a JSON array, or the non-empty lines of JSON lines. Lines that aren't JSON are
+// returned as they are, to fail on their own.
+func splitBatch(body []byte) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(body)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		var articles []json.RawMessage
+		err := json.Unmarshal(trimmed, &articles)
+		return articles, err
+	}
+	articles := make([]json.RawMessage, 0)
+	for _, line := range bytes.Split(trimmed, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) != 0 {
+			articles = append(articles, json.RawMessage(line))
+		}
+	}
+	return articles, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func postBatch(h *batchMappingHandler, body string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest("POST", "/map/batch", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(h.handle).ServeHTTP(recorder, request)
+	return recorder
+}
+
+func batchLines(t *testing.T, body string) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		var result map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &result))
+		lines = append(lines, result)
+	}
+	return lines
+}
+
+func TestBatchMapping_JSONArray(t *testing.T) {
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	imageSetMapper := newImageSetMapper(defaultArticleToImageSetMapper{}, defaultAttributesMapper{}, defaultImageSetToJSONMapper{})
+	h := newBatchMappingHandler(defaultMessageToNativeMapper{}, imageSetMapper, 1024*1024, 2)
+
+	recorder := postBatch(h, "["+string(article)+`,{"uuid":"e5b5d4a4-0c5c-4b2e-a6b5-2b4a40c1e3d9","value":"","attributes":""},"not an article"]`)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/x-ndjson;charset=utf-8", recorder.Header().Get("Content-Type"))
+	lines := batchLines(t, recorder.Body.String())
+	assert.Len(t, lines, 3)
+	assert.Equal(t, float64(0), lines[0]["index"])
+	assert.Equal(t, "c17e8abe-1df8-11e7-942c-4a4c42b3072e", lines[0]["uuid"])
+	assert.Len(t, lines[0]["imageSets"], 2)
+	assert.Equal(t, "e5b5d4a4-0c5c-4b2e-a6b5-2b4a40c1e3d9", lines[1]["uuid"])
+	assert.Contains(t, lines[1]["error"].(map[string]interface{})["message"], "Error mapping the given content.")
+	assert.Equal(t, float64(2), lines[2]["index"])
+	assert.Nil(t, lines[2]["uuid"])
+	assert.Contains(t, lines[2]["error"].(map[string]interface{})["message"], "Error mapping native message.")
+}
+
+func TestBatchMapping_JSONLinesKeepOrder(t *testing.T) {
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	for _, uuid := range []string{"a", "b", "c", "d"} {
+		mockedMessageToNativeMapper.On("Map", []byte(`{"uuid":"`+uuid+`"}`)).Return(NativeContent{Uuid: uuid}, nil)
+	}
+	h := newBatchMappingHandler(mockedMessageToNativeMapper, &slowImageSetMapper{delays: map[string]time.Duration{"a": 30 * time.Millisecond}}, 1024, 4)
+
+	recorder := postBatch(h, "{\"uuid\":\"a\"}\n\n{\"uuid\":\"b\"}\r\n{\"uuid\":\"c\"}\n{\"uuid\":\"d\"}")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	lines := batchLines(t, recorder.Body.String())
+	assert.Len(t, lines, 4)
+	for i, uuid := range []string{"a", "b", "c", "d"} {
+		assert.Equal(t, float64(i), lines[i]["index"])
+		assert.Equal(t, uuid, lines[i]["uuid"])
+		assert.Equal(t, []interface{}{}, lines[i]["imageSets"])
+	}
+}
+
+func TestBatchMapping_LimitsConcurrency(t *testing.T) {
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(NativeContent{}, nil)
+	imageSetMapper := &slowImageSetMapper{delay: 5 * time.Millisecond}
+	h := newBatchMappingHandler(mockedMessageToNativeMapper, imageSetMapper, 1024, 2)
+
+	recorder := postBatch(h, strings.Repeat("{}\n", 10))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, batchLines(t, recorder.Body.String()), 10)
+	assert.Equal(t, 2, imageSetMapper.mostRunning)
+}
+
+func TestBatchMapping_RejectsTooLargeBatch(t *testing.T) {
+	h := newBatchMappingHandler(nil, nil, 10, 1)
+	recorder := postBatch(h, "[{},{},{},{}]")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `{"message":"Batch is larger than the limit of 10 bytes.","code":"BATCH_TOO_LARGE"`)
+}
+
+func TestBatchMapping_RejectsInvalidArray(t *testing.T) {
+	h := newBatchMappingHandler(nil, nil, 1024, 1)
+	recorder := postBatch(h, `[{"uuid":"a"},`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "Couldn't read batch as a JSON array of articles.")
+}
+
+func TestBatchMapping_StopsWhenRequestEnds(t *testing.T) {
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(NativeContent{}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	imageSetMapper := &cancellingImageSetMapper{cancel: cancel}
+	h := newBatchMappingHandler(mockedMessageToNativeMapper, imageSetMapper, 1024, 1)
+
+	request, _ := http.NewRequest("POST", "/map/batch", strings.NewReader(strings.Repeat("{}\n", 10)))
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(h.handle).ServeHTTP(recorder, request.WithContext(ctx))
+
+	assert.Equal(t, 1, imageSetMapper.calls, "No article should be mapped after the request ended")
+	assert.True(t, strings.Count(recorder.Body.String(), "\n") <= 1)
+}
+
+// cancellingImageSetMapper ends the request of a batch as soon as it maps its first article.
+type cancellingImageSetMapper struct {
+	sync.Mutex
+	cancel context.CancelFunc
+	calls  int
+}
+
+func (m *cancellingImageSetMapper) Map(native NativeContent, lastModified string, publishReference string) ([]JSONImageSet, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.calls++
+	m.cancel()
+	return nil, nil
+}
+
+// slowImageSetMapper takes its time mapping, to check the order and the concurrency of a batch.
+type slowImageSetMapper struct {
+	sync.Mutex
+	delay       time.Duration
+	delays      map[string]time.Duration
+	running     int
+	mostRunning int
+}
+
+func (m *slowImageSetMapper) Map(native NativeContent, lastModified string, publishReference string) ([]JSONImageSet, error) {
+	m.Lock()
+	m.running++
+	if m.running > m.mostRunning {
+		m.mostRunning = m.running
+	}
+	delay, found := m.delays[native.Uuid]
+	if !found {
+		delay = m.delay
+	}
+	m.Unlock()
+	time.Sleep(delay)
+	m.Lock()
+	m.running--
+	m.Unlock()
+	return nil, nil
+}
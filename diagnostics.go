@@ -0,0 +1,38 @@
+package main
+
+const (
+	errorSeverity   = "error"
+	warningSeverity = "warning"
+)
+
+// MappingDiagnostic is a problem found while mapping an article. Errors stop the whole article from being mapped,
+// warnings only leave something out of an image-set.
+type MappingDiagnostic struct {
+	Code       string `json:"code"`
+	Severity   string `json:"severity"`
+	Stage      string `json:"stage,omitempty"`
+	Field      string `json:"field,omitempty"`
+	ImageSetID string `json:"imageSetId,omitempty"`
+	Member     string `json:"member,omitempty"`
+	Message    string `json:"message"`
+}
+
+func newErrorDiagnostic(err *mappingError) MappingDiagnostic {
+	return MappingDiagnostic{
+		Code:       err.code,
+		Severity:   errorSeverity,
+		Stage:      err.stage,
+		Field:      err.field,
+		ImageSetID: err.imageSetID,
+		Message:    err.Error(),
+	}
+}
+
+func hasErrors(diagnostics []MappingDiagnostic) bool {
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Severity == errorSeverity {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	trans "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/Sirupsen/logrus"
+	"github.com/jawher/mow.cli"
+)
+
+// diffCommand prints what changed in the image-sets between two versions of an article, read from native article
+// files. Like diff, it exits with 1 when they differ and 2 when they can't be compared.
+func (a *app) diffCommand(cmd *cli.Cmd) {
+	cmd.Spec = "FROM TO"
+	fromPath := cmd.String(cli.StringArg{
+		Name: "FROM",
+		Desc: "Native article file of the old version.",
+	})
+	toPath := cmd.String(cli.StringArg{
+		Name: "TO",
+		Desc: "Native article file of the new version.",
+	})
+	cmd.Action = func() {
+		articles := make([][]byte, 0, 2)
+		for _, path := range []string{*fromPath, *toPath} {
+			article, err := ioutil.ReadFile(path)
+			if err != nil {
+				logEvent(serviceEvent, "").WithField("path", path).WithError(err).Error("Couldn't read native article.")
+				cli.Exit(2)
+			}
+			articles = append(articles, article)
+		}
+		imageSetMapper := newImageSetMapper(defaultArticleToImageSetMapper{}, defaultAttributesMapper{}, defaultImageSetToJSONMapper{})
+		diff, err := diffNativeArticles(defaultMessageToNativeMapper{}, imageSetMapper, articles[0], articles[1], trans.NewTransactionID())
+		if err != nil {
+			logEvent(mapEvent, "").WithFields(logrus.Fields{stageField: err.stage, "code": err.code}).WithError(err).Error("Couldn't compare the articles.")
+			cli.Exit(2)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(diff); err != nil {
+			logEvent(serviceEvent, "").WithError(err).Error("Couldn't write image-set diff.")
+			cli.Exit(2)
+		}
+		if !diff.isEmpty() {
+			cli.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	trans "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/Sirupsen/logrus"
+)
+
+// diffHandler compares the image-sets of two versions of an article, given as native messages.
+type diffHandler struct {
+	defaultHTTPMappingHandler
+}
+
+// diffRequest holds the old version of the article as from and the new one as to.
+type diffRequest struct {
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+func newDiffHandler(messageToNativeMapper MessageToNativeMapper, imageSetMapper ImageSetMapper) *diffHandler {
+	return &diffHandler{defaultHTTPMappingHandler{messageToNativeMapper: messageToNativeMapper, imageSetMapper: imageSetMapper}}
+}
+
+func (h *diffHandler) handle(w http.ResponseWriter, r *http.Request) {
+	tid := trans.GetTransactionIDFromRequest(r)
+	w.Header().Add("Content-Type", "application/json;charset=utf-8")
+	w.Header().Add(trans.TransactionIDHeader, tid)
+
+	body, err := ioutil.ReadAll(r.Body)
+	defer closeRequestBody(r)
+	if err != nil {
+		writeError(w, newInternalError(requestStage, fmt.Errorf("Cound't read from request body. %v", err)), tid)
+		return
+	}
+	var request diffRequest
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		writeError(w, newMappingError(invalidRequestCode, requestStage, "", fmt.Errorf("Couldn't read the articles to compare. %v", err)), tid)
+		return
+	}
+	for _, version := range []struct {
+		name    string
+		article json.RawMessage
+	}{{fromArticle, request.From}, {toArticle, request.To}} {
+		if len(version.article) == 0 || string(version.article) == "null" {
+			writeError(w, newMappingError(partMissingCode, requestStage, version.name, fmt.Errorf("Missing the %v article", version.name)), tid)
+			return
+		}
+	}
+
+	diff, mappingErr := diffNativeArticles(h.messageToNativeMapper, h.imageSetMapper, request.From, request.To, tid)
+	if mappingErr != nil {
+		writeError(w, mappingErr, tid)
+		return
+	}
+	logEvent(requestEvent, tid).WithFields(logrus.Fields{"added": len(diff.Added), "removed": len(diff.Removed), "changed": len(diff.Changed), "unchanged": diff.Unchanged}).Info("Compared image-sets.")
+	marshaledDiff, err := json.Marshal(diff)
+	if err != nil {
+		writeError(w, newInternalError(responseStage, fmt.Errorf("Couldn't marshall image-set diff to JSON. %v", err)), tid)
+		return
+	}
+	_, err = w.Write(marshaledDiff)
+	if err != nil {
+		logEvent(requestEvent, tid).WithError(err).Warn("Couldn't write to response.")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/message-queue-go-producer/producer"
+	"github.com/Sirupsen/logrus"
+)
+
+const dryRunPath = "/__dry-run-messages"
+
+// dryRunProducer records the messages instead of sending them, so that the service can be run against production
+// traffic without publishing anything. Its connectivity check is the one of the producer it replaces.
+type dryRunProducer struct {
+	producer.MessageProducer
+	name     string
+	recorder *dryRunMessages
+}
+
+// dryRunMessage is a message that would have been sent. Producer tells whether it's an image-set or a relations one.
+type dryRunMessage struct {
+	Producer   string            `json:"producer"`
+	Key        string            `json:"key,omitempty"`
+	RecordedAt string            `json:"recordedAt"`
+	Headers    map[string]string `json:"headers"`
+	Body       json.RawMessage   `json:"body"`
+}
+
+// dryRunMessages keeps the last messages that would have been sent, dropping the oldest ones once it's full.
+type dryRunMessages struct {
+	sync.Mutex
+	messages []dryRunMessage
+	next     int
+	full     bool
+}
+
+func newDryRunMessages(size int) *dryRunMessages {
+	if size < 1 {
+		size = 1
+	}
+	return &dryRunMessages{messages: make([]dryRunMessage, size)}
+}
+
+func newDryRunProducer(messageProducer producer.MessageProducer, name string, recorder *dryRunMessages) producer.MessageProducer {
+	if messageProducer == nil {
+		return nil
+	}
+	return &dryRunProducer{MessageProducer: messageProducer, name: name, recorder: recorder}
+}
+
+func (p *dryRunProducer) SendMessage(key string, msg producer.Message) error {
+	body := json.RawMessage(msg.Body)
+	if !json.Valid(body) {
+		body, _ = json.Marshal(msg.Body)
+	}
+	p.recorder.record(dryRunMessage{
+		Producer:   p.name,
+		Key:        key,
+		RecordedAt: time.Now().UTC().Format(uppDateFormat),
+		Headers:    msg.Headers,
+		Body:       body,
+	})
+	logEvent(sendEvent, msg.Headers["X-Request-Id"]).WithFields(logrus.Fields{"producer": p.name, "message_id": msg.Headers["Message-Id"]}).Info("Dry-run, not sending message.")
+	return nil
+}
+
+func (d *dryRunMessages) record(msg dryRunMessage) {
+	d.Lock()
+	defer d.Unlock()
+	d.messages[d.next] = msg
+	d.next = (d.next + 1) % len(d.messages)
+	if d.next == 0 {
+		d.full = true
+	}
+}
+
+// recorded returns the kept messages, oldest first.
+func (d *dryRunMessages) recorded() []dryRunMessage {
+	d.Lock()
+	defer d.Unlock()
+	if !d.full {
+		return append([]dryRunMessage{}, d.messages[:d.next]...)
+	}
+	return append(append([]dryRunMessage{}, d.messages[d.next:]...), d.messages[:d.next]...)
+}
+
+func (d *dryRunMessages) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json;charset=utf-8")
+	marshaled, err := json.Marshal(d.recorded())
+	if err != nil {
+		logEvent(requestEvent, "").WithError(err).Warn("Couldn't marshall dry-run messages to JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(marshaled)
+	if err != nil {
+		logEvent(requestEvent, "").WithError(err).Warn("Couldn't write to response.")
+	}
+}
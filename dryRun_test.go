@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/message-queue-go-producer/producer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDryRunMessages_KeepsTheLastOnes(t *testing.T) {
+	d := newDryRunMessages(3)
+	assert.Empty(t, d.recorded())
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		d.record(dryRunMessage{Key: key})
+	}
+	keys := make([]string, 0)
+	for _, msg := range d.recorded() {
+		keys = append(keys, msg.Key)
+	}
+	assert.Equal(t, []string{"c", "d", "e"}, keys)
+}
+
+func TestDryRunProducer_RecordsInsteadOfSending(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	d := newDryRunMessages(10)
+	q := newTimestampTestQueue(mockedProducer)
+	q.messageProducer = newDryRunProducer(mockedProducer, "image-sets", d)
+
+	assert.NoError(t, q.onMessage(articleMessage("2017-05-15T15:54:32.166Z", nil)))
+
+	mockedProducer.AssertNotCalled(t, "SendMessage", mock.Anything, mock.Anything)
+	recorded := d.recorded()
+	assert.Len(t, recorded, 1)
+	assert.Equal(t, "image-sets", recorded[0].Producer)
+	assert.Equal(t, "2017-05-15T15:54:32.166Z", recorded[0].Headers["Message-Timestamp"])
+	var body publicationMessageBody
+	assert.NoError(t, json.Unmarshal(recorded[0].Body, &body))
+	assert.Equal(t, "512c1f3d-e48c-4618-863c-94bc9d913b9b", body.Payload.UUID)
+}
+
+func TestDryRun_RecordsNothing(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	q := newTimestampTestQueue(mockedProducer)
+	q.messageProducer = newDryRunProducer(mockedProducer, "image-sets", newDryRunMessages(10))
+	q.dryRun = true
+	q.articleVersions = newArticleVersions(10)
+	store, cleanup := newTestImageSetStore(t)
+	defer cleanup()
+	q.imageSetStore = store
+
+	assert.NoError(t, q.onMessage(articleMessage("2017-05-15T15:54:32.166Z", nil)))
+
+	stale, _ := q.articleVersions.isStale(testArticleUUID, time.Date(2017, 5, 15, 15, 54, 32, 165000000, time.UTC))
+	assert.False(t, stale, "The version shouldn't be remembered")
+	origin, err := store.origin("512c1f3d-e48c-4618-863c-94bc9d913b9b")
+	assert.NoError(t, err)
+	assert.Nil(t, origin, "The mapping shouldn't be recorded")
+	_, found, err := store.articleImageSets(testArticleUUID)
+	assert.NoError(t, err)
+	assert.False(t, found, "The image-sets shouldn't be stored")
+}
+
+func TestDryRunMessages_Endpoint(t *testing.T) {
+	d := newDryRunMessages(10)
+	assert.NoError(t, newDryRunProducer(new(mockProducer), "relations", d).SendMessage("c17e8abe-1df8-11e7-942c-4a4c42b3072e",
+		producer.Message{Headers: map[string]string{"Message-Type": relationsMessageType}, Body: `{"imageSets":[]}`}))
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", dryRunPath, nil)
+	assert.NoError(t, err)
+	http.HandlerFunc(d.handle).ServeHTTP(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var recorded []dryRunMessage
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &recorded))
+	assert.Len(t, recorded, 1)
+	assert.Equal(t, "c17e8abe-1df8-11e7-942c-4a4c42b3072e", recorded[0].Key)
+	assert.JSONEq(t, `{"imageSets":[]}`, string(recorded[0].Body))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
@@ -17,6 +18,7 @@ type HealthCheck struct {
 	producer      producer.MessageProducer
 	appSystemCode string
 	appName       string
+	shuttingDown  int32
 }
 
 func NewHealthCheck(p producer.MessageProducer, c consumer.MessageConsumer, systemCode, appName string) *HealthCheck {
@@ -66,7 +68,15 @@ func (h *HealthCheck) writeQueueCheck() fthealth.Check {
 	}
 }
 
+// markShuttingDown makes GTG fail from now on, so no new traffic is routed to the service while it drains.
+func (h *HealthCheck) markShuttingDown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
 func (h *HealthCheck) GTG() gtg.Status {
+	if atomic.LoadInt32(&h.shuttingDown) == 1 {
+		return gtg.Status{GoodToGo: false, Message: "Service is shutting down"}
+	}
 	consumerCheck := func() gtg.Status {
 		return gtgCheck(h.consumer.ConnectivityCheck)
 	}
@@ -108,6 +108,15 @@ func TestGTGBrokenProducer(t *testing.T) {
 	assert.Equal(t, "Error connecting to the queue", status.Message)
 }
 
+func TestGTGShuttingDown(t *testing.T) {
+	hc := initializeHealthCheck(true, true)
+	hc.markShuttingDown()
+
+	status := hc.GTG()
+	assert.False(t, status.GoodToGo)
+	assert.Equal(t, "Service is shutting down", status.Message)
+}
+
 type mockProducerInstance struct {
 	isConnectionHealthy bool
 }
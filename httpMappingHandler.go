@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	trans "github.com/Financial-Times/transactionid-utils-go"
@@ -10,12 +11,25 @@ import (
 	"time"
 )
 
+// ErrorMessage is the body of the error responses, and the error of an article of a batch.
 type ErrorMessage struct {
-	Message string `json:"message"`
+	Message       string `json:"message"`
+	Code          string `json:"code"`
+	Stage         string `json:"stage,omitempty"`
+	Field         string `json:"field,omitempty"`
+	ImageSetID    string `json:"imageSetId,omitempty"`
+	TransactionID string `json:"transactionId,omitempty"`
 }
 
-func newHTTPErrorMessage(msg string) ErrorMessage {
-	return ErrorMessage{Message: msg}
+func newHTTPErrorMessage(err *mappingError, tid string) ErrorMessage {
+	return ErrorMessage{
+		Message:       err.Error(),
+		Code:          err.code,
+		Stage:         err.stage,
+		Field:         err.field,
+		ImageSetID:    err.imageSetID,
+		TransactionID: tid,
+	}
 }
 
 type HTTPMappingHandler interface {
@@ -25,12 +39,23 @@ type HTTPMappingHandler interface {
 type defaultHTTPMappingHandler struct {
 	messageToNativeMapper MessageToNativeMapper
 	imageSetMapper        ImageSetMapper
+	queue                 *defaultQueue
+}
+
+// publicationMessageView is a message as the queue would send it, returned by /map?view=publication.
+type publicationMessageView struct {
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
 }
 
-func newHTTPMappingHandler(messageToNativeMapper MessageToNativeMapper, imageSetMapper ImageSetMapper) HTTPMappingHandler {
+const publicationView = "publication"
+
+// newHTTPMappingHandler returns the handler of /map. The queue builds the messages returned with view=publication.
+func newHTTPMappingHandler(messageToNativeMapper MessageToNativeMapper, imageSetMapper ImageSetMapper, queue *defaultQueue) HTTPMappingHandler {
 	return defaultHTTPMappingHandler{
 		messageToNativeMapper: messageToNativeMapper,
 		imageSetMapper:        imageSetMapper,
+		queue:                 queue,
 	}
 }
 
@@ -39,61 +64,134 @@ func (h defaultHTTPMappingHandler) handle(w http.ResponseWriter, r *http.Request
 	w.Header().Add("Content-Type", "application/json;charset=utf-8")
 	w.Header().Add(trans.TransactionIDHeader, tid)
 
-	body, err := ioutil.ReadAll(r.Body)
-	defer h.closeRequestBody(r)
-	if err != nil {
-		h.warnAndWriteToHTTP500(fmt.Sprintf("Cound't read from request body. %v\n", err), w)
+	view := r.URL.Query().Get("view")
+	if view != "" && view != publicationView {
+		writeError(w, newMappingError(invalidRequestCode, requestStage, "view", fmt.Errorf("Unknown view=%v, the only one is %v.", view, publicationView)), tid)
 		return
 	}
 
-	native, err := h.messageToNativeMapper.Map(body)
-	if err != nil {
-		h.writeToHTTP(fmt.Sprintf("Error mapping native message. %v\n", err), http.StatusUnprocessableEntity, w)
+	native, ok := h.readNative(w, r, tid)
+	if !ok {
 		return
 	}
 
-	imageSets, err := h.imageSetMapper.Map(native, time.Now().Format(uppDateFormat), tid)
+	lastModified := time.Now().UTC().Format(uppDateFormat)
+	imageSets, err := h.imageSetMapper.Map(native, lastModified, tid)
 	if err != nil {
-		h.writeToHTTP(fmt.Sprintf("Error mapping the given content. %v\n", err), http.StatusUnprocessableEntity, w)
+		writeError(w, asMappingError(err, mappingFailedCode, imageSetStage).prefixed("Error mapping the given content."), tid)
 		return
 	}
 
 	if len(imageSets) == 0 {
-		logrus.Infof("No image-sets were found in this article. transactionId=%v", tid)
+		logEvent(mapEvent, tid).WithField(uuidField, native.Uuid).Info("No image-sets were found in this article.")
+	}
+	if view == publicationView {
+		h.writePublicationMessages(w, r, imageSets, lastModified, tid)
+		return
 	}
 	marshaledJSONImageSets, err := json.Marshal(imageSets)
 	if err != nil {
-		h.warnAndWriteToHTTP500(fmt.Sprintf("Couldn't marshall built-up image-sets to JSON. %v\n", err), w)
+		writeError(w, newInternalError(responseStage, fmt.Errorf("Couldn't marshall built-up image-sets to JSON. %v", err)), tid)
 		return
 	}
 
 	_, err = w.Write(marshaledJSONImageSets)
 	if err != nil {
-		h.warnAndWriteToHTTP500(fmt.Sprintf("Cound't write response. %v\n", err), w)
+		logEvent(requestEvent, tid).WithError(err).Warn("Couldn't write to response.")
 	}
 }
 
-func (h defaultHTTPMappingHandler) warnAndWriteToHTTP500(msg string, w http.ResponseWriter) {
-	logrus.Warn(msg)
-	h.writeToHTTP(msg, http.StatusInternalServerError, w)
+// readNative reads the article in the format of the request Content-Type: multipart/form-data, an XML bundle, or
+// otherwise the native JSON. It writes the error response itself, returning false, when the article can't be read.
+func (h defaultHTTPMappingHandler) readNative(w http.ResponseWriter, r *http.Request, tid string) (NativeContent, bool) {
+	defer closeRequestBody(r)
+	mediaType := requestMediaType(r)
+	if mediaType == multipartMediaType {
+		native, err := nativeFromMultipart(r)
+		if err != nil {
+			writeError(w, asMappingError(err, invalidRequestCode, requestStage).prefixed("Error reading multipart article."), tid)
+			return NativeContent{}, false
+		}
+		return native, true
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, newInternalError(requestStage, fmt.Errorf("Cound't read from request body. %v", err)), tid)
+		return NativeContent{}, false
+	}
+	if isXMLBundle(mediaType) {
+		native, err := nativeFromXMLBundle(body)
+		if err != nil {
+			writeError(w, asMappingError(err, invalidRequestCode, requestStage).prefixed("Error reading XML bundle."), tid)
+			return NativeContent{}, false
+		}
+		return native, true
+	}
+	native, err := h.messageToNativeMapper.Map(body)
+	if err != nil {
+		writeError(w, newMappingError(invalidNativeJSONCode, nativeStage, "", fmt.Errorf("Error mapping native message. %v", err)), tid)
+		return NativeContent{}, false
+	}
+	return native, true
 }
 
-func (h defaultHTTPMappingHandler) writeToHTTP(msg string, status int, w http.ResponseWriter) {
-	httpMsg, marshalErr := json.Marshal(newHTTPErrorMessage(msg))
-	if marshalErr != nil {
-		w.WriteHeader(status)
+// writePublicationMessages writes the messages the queue would send for the image-sets, as if the request was the
+// consumed message: its Origin-System-Id and the headers configured for pass-through are taken from the request.
+func (h defaultHTTPMappingHandler) writePublicationMessages(w http.ResponseWriter, r *http.Request, imageSets []JSONImageSet, lastModified string, tid string) {
+	inboundHeaders := map[string]string{"Origin-System-Id": r.Header.Get("Origin-System-Id")}
+	if inboundHeaders["Origin-System-Id"] == "" {
+		inboundHeaders["Origin-System-Id"] = h.queue.acceptedOrigins[0]
+	}
+	for _, name := range h.queue.passThroughHeaders {
+		if value := r.Header.Get(name); value != "" {
+			inboundHeaders[name] = value
+		}
+	}
+	msgs, errs := h.queue.publicationMessages(imageSets, lastModified, tid, inboundHeaders)
+	if len(errs) != 0 {
+		h.queue.logBuildErrors(imageSets, errs, tid)
+		writeError(w, newInternalError(responseStage, fmt.Errorf("Couldn't build %v of %v messages.", len(errs), len(imageSets))), tid)
 		return
 	}
-	w.WriteHeader(status)
-	_, err := w.Write(httpMsg)
+	views := make([]publicationMessageView, 0, len(msgs))
+	for _, msg := range msgs {
+		views = append(views, publicationMessageView{Headers: msg.message.Headers, Body: json.RawMessage(msg.message.Body)})
+	}
+	encoded := new(bytes.Buffer)
+	encoder := json.NewEncoder(encoded)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(views)
+	if err != nil {
+		writeError(w, newInternalError(responseStage, fmt.Errorf("Couldn't marshall publication messages to JSON. %v", err)), tid)
+		return
+	}
+	_, err = w.Write(bytes.TrimSuffix(encoded.Bytes(), []byte("\n")))
 	if err != nil {
-		logrus.Warnf("Couldn't write to response. %v\n", err)
+		logEvent(requestEvent, tid).WithError(err).Warn("Couldn't write to response.")
+	}
+}
+
+// writeError writes the error with the status of its class. Failures of the service are also logged.
+func writeError(w http.ResponseWriter, err *mappingError, tid string) {
+	status := err.status()
+	if status >= http.StatusInternalServerError {
+		logEvent(requestEvent, tid).WithFields(logrus.Fields{stageField: err.stage, "code": err.code}).Warn(err.Error())
+	}
+	httpMsg, marshalErr := json.Marshal(newHTTPErrorMessage(err, tid))
+	w.WriteHeader(status)
+	if marshalErr != nil {
+		return
+	}
+	_, writeErr := w.Write(httpMsg)
+	if writeErr != nil {
+		logEvent(requestEvent, tid).WithError(writeErr).Warn("Couldn't write to response.")
 	}
 }
 
-func (h defaultHTTPMappingHandler) closeRequestBody(r *http.Request) {
+func closeRequestBody(r *http.Request) {
 	err := r.Body.Close()
 	if err != nil {
-		logrus.Warnf("Couldn't close request body. %v\n", err)
+		logEvent(requestEvent, "").WithError(err).Warn("Couldn't close request body.")
 	}
 }
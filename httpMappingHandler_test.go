@@ -2,14 +2,17 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	trans "github.com/Financial-Times/transactionid-utils-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestHttpHandler_Ok(t *testing.T) {
@@ -21,7 +24,7 @@ func TestHttpHandler_Ok(t *testing.T) {
 	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(NativeContent{}, nil)
 	mockedImageSetMapper := new(mockImageSetMapper)
 	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return([]JSONImageSet{}, nil)
-	httpHandler := newHTTPMappingHandler(mockedMessageToNativeMapper, mockedImageSetMapper)
+	httpHandler := newHTTPMappingHandler(mockedMessageToNativeMapper, mockedImageSetMapper, nil)
 	recorder := httptest.NewRecorder()
 	handler := http.HandlerFunc(httpHandler.handle)
 	handler.ServeHTTP(recorder, request)
@@ -38,12 +41,13 @@ func TestHttpHandler_ErrorOnNativeMapper(t *testing.T) {
 	}
 	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
 	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(NativeContent{}, errors.New("error on native mapper"))
-	httpHandler := newHTTPMappingHandler(mockedMessageToNativeMapper, nil)
+	httpHandler := newHTTPMappingHandler(mockedMessageToNativeMapper, nil, nil)
 	recorder := httptest.NewRecorder()
 	handler := http.HandlerFunc(httpHandler.handle)
 	handler.ServeHTTP(recorder, request)
-	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
 	assert.True(t, strings.Contains(string(recorder.Body.Bytes()), `{"message":"Error mapping native message.`))
+	assert.Contains(t, recorder.Body.String(), `"code":"NATIVE_JSON_INVALID","stage":"native"`)
 }
 
 func TestHttpHandler_ErrorOnImageSetMapper(t *testing.T) {
@@ -55,10 +59,75 @@ func TestHttpHandler_ErrorOnImageSetMapper(t *testing.T) {
 	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(NativeContent{}, nil)
 	mockedImageSetMapper := new(mockImageSetMapper)
 	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return([]JSONImageSet{}, errors.New("error on image set mapper"))
-	httpHandler := newHTTPMappingHandler(mockedMessageToNativeMapper, mockedImageSetMapper)
+	httpHandler := newHTTPMappingHandler(mockedMessageToNativeMapper, mockedImageSetMapper, nil)
 	recorder := httptest.NewRecorder()
 	handler := http.HandlerFunc(httpHandler.handle)
 	handler.ServeHTTP(recorder, request)
 	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
 	assert.True(t, strings.Contains(string(recorder.Body.Bytes()), `{"message":"Error mapping the given content.`))
+	assert.Contains(t, recorder.Body.String(), `"code":"MAPPING_FAILED","stage":"image-set"`)
+}
+
+func TestHttpHandler_PublicationView(t *testing.T) {
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	request, err := http.NewRequest("POST", "/map?view=publication", bytes.NewReader(article))
+	assert.NoError(t, err)
+	request.Header.Set("X-Request-Id", "tid_test")
+	request.Header.Set("X-Native-Hash", "abc")
+	imageSetMapper := newImageSetMapper(defaultArticleToImageSetMapper{}, defaultAttributesMapper{}, defaultImageSetToJSONMapper{})
+	q := newQueue(nil, nil, nil, nil)
+	q.passThroughHeaders = []string{"X-Native-Hash"}
+	q.extraHeaders = map[string]string{"X-Environment": "staging"}
+	httpHandler := newHTTPMappingHandler(defaultMessageToNativeMapper{}, imageSetMapper, q)
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(httpHandler.handle).ServeHTTP(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var views []publicationMessageView
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &views))
+	assert.Len(t, views, 2)
+	assert.Equal(t, "tid_test", views[0].Headers["X-Request-Id"])
+	assert.Equal(t, "cms-content-published", views[0].Headers["Message-Type"])
+	assert.Equal(t, methodeSystemOrigin, views[0].Headers["Origin-System-Id"])
+	assert.Equal(t, "abc", views[0].Headers["X-Native-Hash"])
+	assert.Equal(t, "staging", views[0].Headers["X-Environment"])
+
+	var body publicationMessageBody
+	assert.NoError(t, json.Unmarshal(views[0].Body, &body))
+	expected, err := q.buildMessage(body.Payload, views[0].Headers["Message-Timestamp"], "tid_test", methodeSystemOrigin, map[string]string{"X-Native-Hash": "abc"})
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Body, string(views[0].Body), "The body should be exactly the one published")
+}
+
+func TestHttpHandler_PublicationViewInUTC(t *testing.T) {
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.FixedZone("CEST", 2*60*60)
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	request, err := http.NewRequest("POST", "/map?view=publication", bytes.NewReader(article))
+	assert.NoError(t, err)
+	imageSetMapper := newImageSetMapper(defaultArticleToImageSetMapper{}, defaultAttributesMapper{}, defaultImageSetToJSONMapper{})
+	httpHandler := newHTTPMappingHandler(defaultMessageToNativeMapper{}, imageSetMapper, newQueue(nil, nil, nil, nil))
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(httpHandler.handle).ServeHTTP(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var views []publicationMessageView
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &views))
+	var body publicationMessageBody
+	assert.NoError(t, json.Unmarshal(views[0].Body, &body))
+	assert.True(t, strings.HasSuffix(views[0].Headers["Message-Timestamp"], "Z"), views[0].Headers["Message-Timestamp"])
+	assert.True(t, strings.HasSuffix(body.LastModified, "Z"), body.LastModified)
+	assert.Equal(t, body.LastModified, body.Payload.LastModified)
+}
+
+func TestHttpHandler_UnknownView(t *testing.T) {
+	request, err := http.NewRequest("POST", "/map?view=everything", bytes.NewReader([]byte("")))
+	assert.NoError(t, err)
+	httpHandler := newHTTPMappingHandler(nil, nil, nil)
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(httpHandler.handle).ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `{"message":"Unknown view=everything`)
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	fromArticle = "from"
+	toArticle   = "to"
+)
+
+// imageSetDiff is what changed in the image-sets between two versions of an article. Image-sets are matched by uuid,
+// added ones are in the body order of the new version, removed and changed ones in the order of the old one.
+type imageSetDiff struct {
+	Added     []JSONImageSet   `json:"added"`
+	Removed   []JSONImageSet   `json:"removed"`
+	Changed   []imageSetChange `json:"changed"`
+	Unchanged int              `json:"unchanged"`
+}
+
+// imageSetChange is a changed image-set. Its members are matched by uuid, like the image-sets themselves.
+type imageSetChange struct {
+	UUID           string        `json:"uuid"`
+	MethodeID      string        `json:"methodeId"`
+	Fields         []fieldChange `json:"fields"`
+	AddedMembers   []JSONMember  `json:"addedMembers"`
+	RemovedMembers []JSONMember  `json:"removedMembers"`
+}
+
+// fieldChange is a field of an image-set, or of one of the members it kept like members[<uuid>].maxDisplayWidth, that
+// changed.
+type fieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+func (d imageSetDiff) isEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (c imageSetChange) isEmpty() bool {
+	return len(c.Fields) == 0 && len(c.AddedMembers) == 0 && len(c.RemovedMembers) == 0
+}
+
+// diffNativeArticles maps both versions of the article the same way and compares their image-sets.
+func diffNativeArticles(messageToNativeMapper MessageToNativeMapper, imageSetMapper ImageSetMapper, from []byte, to []byte, tid string) (imageSetDiff, *mappingError) {
+	lastModified := time.Now().UTC().Format(uppDateFormat)
+	imageSets := make(map[string][]JSONImageSet, 2)
+	for _, version := range []struct {
+		name    string
+		article []byte
+	}{{fromArticle, from}, {toArticle, to}} {
+		native, err := messageToNativeMapper.Map(version.article)
+		if err != nil {
+			return imageSetDiff{}, newMappingError(invalidNativeJSONCode, nativeStage, version.name, fmt.Errorf("Error mapping native message of the %v article. %v", version.name, err))
+		}
+		mapped, err := imageSetMapper.Map(native, lastModified, tid)
+		if err != nil {
+			return imageSetDiff{}, asMappingError(err, mappingFailedCode, imageSetStage).prefixed(fmt.Sprintf("Error mapping the %v article.", version.name))
+		}
+		imageSets[version.name] = mapped
+	}
+	return diffImageSets(imageSets[fromArticle], imageSets[toArticle]), nil
+}
+
+func diffImageSets(from []JSONImageSet, to []JSONImageSet) imageSetDiff {
+	diff := imageSetDiff{Added: []JSONImageSet{}, Removed: []JSONImageSet{}, Changed: []imageSetChange{}}
+	toByUUID := make(map[string]JSONImageSet, len(to))
+	for _, imageSet := range to {
+		toByUUID[imageSet.UUID] = imageSet
+	}
+	fromUUIDs := make(map[string]bool, len(from))
+	for _, fromImageSet := range from {
+		fromUUIDs[fromImageSet.UUID] = true
+		toImageSet, found := toByUUID[fromImageSet.UUID]
+		if !found {
+			diff.Removed = append(diff.Removed, fromImageSet)
+			continue
+		}
+		change := diffImageSet(fromImageSet, toImageSet)
+		if change.isEmpty() {
+			diff.Unchanged++
+			continue
+		}
+		diff.Changed = append(diff.Changed, change)
+	}
+	for _, imageSet := range to {
+		if !fromUUIDs[imageSet.UUID] {
+			diff.Added = append(diff.Added, imageSet)
+		}
+	}
+	return diff
+}
+
+// diffImageSet compares what comes from the article. lastModified and publishReference come from the publication
+// instead, and the identifiers from the uuid. Added members are in the order of the new version, removed and changed
+// ones in the order of the old one.
+func diffImageSet(from JSONImageSet, to JSONImageSet) imageSetChange {
+	change := imageSetChange{UUID: from.UUID, MethodeID: from.MethodeID, Fields: []fieldChange{}, AddedMembers: []JSONMember{}, RemovedMembers: []JSONMember{}}
+	change.Fields = appendIfChanged(change.Fields, "publishedDate", from.PublishedDate, to.PublishedDate)
+	change.Fields = appendIfChanged(change.Fields, "firstPublishedDate", from.FirstPublishedDate, to.FirstPublishedDate)
+	change.Fields = appendIfChanged(change.Fields, "canBeDistributed", from.CanBeDistributed, to.CanBeDistributed)
+	change.Fields = appendIfChanged(change.Fields, "type", from.Type, to.Type)
+	toByUUID := make(map[string]JSONMember, len(to.Members))
+	for _, member := range to.Members {
+		toByUUID[member.UUID] = member
+	}
+	fromUUIDs := make(map[string]bool, len(from.Members))
+	for _, fromMember := range from.Members {
+		fromUUIDs[fromMember.UUID] = true
+		toMember, found := toByUUID[fromMember.UUID]
+		if !found {
+			change.RemovedMembers = append(change.RemovedMembers, fromMember)
+			continue
+		}
+		change.Fields = appendIfChanged(change.Fields, fmt.Sprintf("members[%v].maxDisplayWidth", fromMember.UUID), fromMember.MaxDisplayWidth, toMember.MaxDisplayWidth)
+		change.Fields = appendIfChanged(change.Fields, fmt.Sprintf("members[%v].minDisplayWidth", fromMember.UUID), fromMember.MinDisplayWidth, toMember.MinDisplayWidth)
+	}
+	for _, member := range to.Members {
+		if !fromUUIDs[member.UUID] {
+			change.AddedMembers = append(change.AddedMembers, member)
+		}
+	}
+	return change
+}
+
+func appendIfChanged(changes []fieldChange, field string, from string, to string) []fieldChange {
+	if from == to {
+		return changes
+	}
+	return append(changes, fieldChange{Field: field, From: from, To: to})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffImageSets(t *testing.T) {
+	from := []JSONImageSet{
+		{UUID: "4ec94836-0d00-325d-9005-c9aa67f68963", MethodeID: "U1", PublishedDate: "2017-04-10T03:29:14.000Z", LastModified: "2017-05-22T02:59:39.195Z",
+			Members: []JSONMember{{UUID: "41614f4c-13c5-11e7-9469-afea892e4de3"}, {UUID: "4258f26a-13c5-11e7-9469-afea892e4de3", MaxDisplayWidth: "490px"}}},
+		{UUID: "8c07916c-2577-37b6-b477-291094f992ee", MethodeID: "U2", LastModified: "2017-05-22T02:59:39.195Z"},
+		{UUID: "512c1f3d-e48c-4618-863c-94bc9d913b9b", MethodeID: "U3"},
+	}
+	to := []JSONImageSet{
+		{UUID: "43dc1ff3-6d6c-41f3-9196-56dcaa554905", MethodeID: "U4"},
+		{UUID: "4ec94836-0d00-325d-9005-c9aa67f68963", MethodeID: "U1", PublishedDate: "2017-04-11T03:29:14.000Z", LastModified: "2017-05-23T02:59:39.195Z",
+			Members: []JSONMember{{UUID: "41614f4c-13c5-11e7-9469-afea892e4de3"}}},
+		{UUID: "8c07916c-2577-37b6-b477-291094f992ee", MethodeID: "U2", LastModified: "2017-05-23T02:59:39.195Z"},
+	}
+
+	diff := diffImageSets(from, to)
+
+	assert.Equal(t, []JSONImageSet{to[0]}, diff.Added)
+	assert.Equal(t, []JSONImageSet{from[2]}, diff.Removed)
+	assert.Equal(t, 1, diff.Unchanged, "A different lastModified isn't a change")
+	assert.Equal(t, []imageSetChange{{
+		UUID:           "4ec94836-0d00-325d-9005-c9aa67f68963",
+		MethodeID:      "U1",
+		Fields:         []fieldChange{{Field: "publishedDate", From: "2017-04-10T03:29:14.000Z", To: "2017-04-11T03:29:14.000Z"}},
+		AddedMembers:   []JSONMember{},
+		RemovedMembers: []JSONMember{{UUID: "4258f26a-13c5-11e7-9469-afea892e4de3", MaxDisplayWidth: "490px"}},
+	}}, diff.Changed)
+	assert.False(t, diff.isEmpty())
+	assert.True(t, diffImageSets(from, from).isEmpty())
+}
+
+func TestDiffImageSets_RemovedFirstMember(t *testing.T) {
+	from := []JSONImageSet{{UUID: "4ec94836-0d00-325d-9005-c9aa67f68963", MethodeID: "U1", Members: []JSONMember{
+		{UUID: "41614f4c-13c5-11e7-9469-afea892e4de3", MaxDisplayWidth: "490px"},
+		{UUID: "4258f26a-13c5-11e7-9469-afea892e4de3", MinDisplayWidth: "491px"},
+	}}}
+	to := []JSONImageSet{{UUID: "4ec94836-0d00-325d-9005-c9aa67f68963", MethodeID: "U1", Members: []JSONMember{
+		{UUID: "4258f26a-13c5-11e7-9469-afea892e4de3", MinDisplayWidth: "491px"},
+		{UUID: "43dc1ff3-6d6c-41f3-9196-56dcaa554905"},
+	}}}
+
+	diff := diffImageSets(from, to)
+
+	assert.Equal(t, []imageSetChange{{
+		UUID:           "4ec94836-0d00-325d-9005-c9aa67f68963",
+		MethodeID:      "U1",
+		Fields:         []fieldChange{},
+		AddedMembers:   []JSONMember{{UUID: "43dc1ff3-6d6c-41f3-9196-56dcaa554905"}},
+		RemovedMembers: []JSONMember{{UUID: "41614f4c-13c5-11e7-9469-afea892e4de3", MaxDisplayWidth: "490px"}},
+	}}, diff.Changed, "The member that moved to the front isn't a change")
+}
+
+func postDiff(t *testing.T, body []byte) *httptest.ResponseRecorder {
+	imageSetMapper := newImageSetMapper(defaultArticleToImageSetMapper{}, defaultAttributesMapper{}, defaultImageSetToJSONMapper{})
+	request, err := http.NewRequest("POST", "/diff", bytes.NewReader(body))
+	assert.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(newDiffHandler(defaultMessageToNativeMapper{}, imageSetMapper).handle).ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestDiffHandler_ChangedMember(t *testing.T) {
+	from, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	var native NativeContent
+	assert.NoError(t, json.Unmarshal(from, &native))
+	value, err := base64.StdEncoding.DecodeString(native.Value)
+	assert.NoError(t, err)
+	value = bytes.Replace(value, []byte("artboards-s.png?uuid=4258f26a-13c5-11e7-9469-afea892e4de3"), []byte("artboards-s.png?uuid=5258f26a-13c5-11e7-9469-afea892e4de3"), 1)
+	native.Value = base64.StdEncoding.EncodeToString(value)
+	to, err := json.Marshal(native)
+	assert.NoError(t, err)
+	body, err := json.Marshal(diffRequest{From: from, To: to})
+	assert.NoError(t, err)
+
+	recorder := postDiff(t, body)
+
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var diff imageSetDiff
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &diff))
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Equal(t, 1, diff.Unchanged)
+	assert.Len(t, diff.Changed, 1)
+	assert.NotEmpty(t, diff.Changed[0].MethodeID)
+	assert.Empty(t, diff.Changed[0].Fields)
+	assert.Equal(t, []JSONMember{{UUID: "5258f26a-13c5-11e7-9469-afea892e4de3", MaxDisplayWidth: "490px"}}, diff.Changed[0].AddedMembers)
+	assert.Equal(t, []JSONMember{{UUID: "4258f26a-13c5-11e7-9469-afea892e4de3", MaxDisplayWidth: "490px"}}, diff.Changed[0].RemovedMembers)
+}
+
+func TestDiffHandler_MissingArticle(t *testing.T) {
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	body, err := json.Marshal(diffRequest{From: article})
+	assert.NoError(t, err)
+
+	recorder := postDiff(t, body)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"code":"PART_MISSING","stage":"request","field":"to"`)
+}
+
+func TestDiffHandler_UnmappableArticle(t *testing.T) {
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	body, err := json.Marshal(diffRequest{From: article, To: json.RawMessage(`{"uuid":"c17e8abe-1df8-11e7-942c-4a4c42b3072e","value":"***"}`)})
+	assert.NoError(t, err)
+
+	recorder := postDiff(t, body)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `{"message":"Error mapping the to article.`)
+	assert.Contains(t, recorder.Body.String(), `"code":"BAD_BASE64"`)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	trans "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/gorilla/mux"
+)
+
+// imageSetLookupHandler serves what was last published, from the image-set store.
+type imageSetLookupHandler struct {
+	store *imageSetStore
+}
+
+func newImageSetLookupHandler(store *imageSetStore) *imageSetLookupHandler {
+	return &imageSetLookupHandler{store: store}
+}
+
+func (h *imageSetLookupHandler) getImageSet(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+	w.Header().Add("Content-Type", "application/json;charset=utf-8")
+	tid := trans.GetTransactionIDFromRequest(r)
+	w.Header().Add(trans.TransactionIDHeader, tid)
+	imageSet, err := h.store.imageSet(uuid)
+	if err != nil {
+		writeError(w, newInternalError(storeStage, fmt.Errorf("Couldn't read image-set uuid=%v from the store. %v", uuid, err)), tid)
+		return
+	}
+	if imageSet == nil {
+		writeError(w, newMappingError(notFoundCode, storeStage, "uuid", fmt.Errorf("No image-set was published with uuid=%v.", uuid)), tid)
+		return
+	}
+	h.write(imageSet, w, tid)
+}
+
+func (h *imageSetLookupHandler) getArticleImageSets(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+	w.Header().Add("Content-Type", "application/json;charset=utf-8")
+	tid := trans.GetTransactionIDFromRequest(r)
+	w.Header().Add(trans.TransactionIDHeader, tid)
+	imageSets, found, err := h.store.articleImageSets(uuid)
+	if err != nil {
+		writeError(w, newInternalError(storeStage, fmt.Errorf("Couldn't read image-sets of article uuid=%v from the store. %v", uuid, err)), tid)
+		return
+	}
+	if !found {
+		writeError(w, newMappingError(notFoundCode, storeStage, "uuid", fmt.Errorf("Nothing was published for article uuid=%v.", uuid)), tid)
+		return
+	}
+	marshaled, err := json.Marshal(imageSets)
+	if err != nil {
+		writeError(w, newInternalError(responseStage, fmt.Errorf("Couldn't marshall image-sets of article uuid=%v to JSON. %v", uuid, err)), tid)
+		return
+	}
+	h.write(marshaled, w, tid)
+}
+
+func (h *imageSetLookupHandler) getImageSetOrigin(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+	w.Header().Add("Content-Type", "application/json;charset=utf-8")
+	tid := trans.GetTransactionIDFromRequest(r)
+	w.Header().Add(trans.TransactionIDHeader, tid)
+	origin, err := h.store.origin(uuid)
+	if err != nil {
+		writeError(w, newInternalError(storeStage, fmt.Errorf("Couldn't read origin of image-set uuid=%v from the store. %v", uuid, err)), tid)
+		return
+	}
+	if origin == nil {
+		writeError(w, newMappingError(notFoundCode, storeStage, "uuid", fmt.Errorf("No image-set was mapped with uuid=%v.", uuid)), tid)
+		return
+	}
+	marshaled, err := json.Marshal(origin)
+	if err != nil {
+		writeError(w, newInternalError(responseStage, fmt.Errorf("Couldn't marshall origin of image-set uuid=%v to JSON. %v", uuid, err)), tid)
+		return
+	}
+	h.write(marshaled, w, tid)
+}
+
+func (h *imageSetLookupHandler) write(body []byte, w http.ResponseWriter, tid string) {
+	_, err := w.Write(body)
+	if err != nil {
+		logEvent(requestEvent, tid).WithError(err).Warn("Couldn't write to response.")
+	}
+}
@@ -13,6 +13,12 @@ type ImageSetMapper interface {
 	Map(source NativeContent, lastModified string, publishReference string) ([]JSONImageSet, error)
 }
 
+// DiagnosingImageSetMapper also tells what it found wrong with the article, for /validate.
+type DiagnosingImageSetMapper interface {
+	ImageSetMapper
+	MapWithDiagnostics(source NativeContent, lastModified string, publishReference string) ([]JSONImageSet, []MappingDiagnostic, error)
+}
+
 type defaultImageSetMapper struct {
 	articleToImageSetMapper ArticleToImageSetMapper
 	attributesMapper        AttributesMapper
@@ -20,7 +26,7 @@ type defaultImageSetMapper struct {
 }
 
 func newImageSetMapper(articleToImageSetMApper ArticleToImageSetMapper, attributesMapper AttributesMapper,
-	xmlImageSetToJSONMapper XMLImageSetToJSONMapper) ImageSetMapper {
+	xmlImageSetToJSONMapper XMLImageSetToJSONMapper) DiagnosingImageSetMapper {
 	return defaultImageSetMapper{
 		articleToImageSetMapper: articleToImageSetMApper,
 		attributesMapper:        attributesMapper,
@@ -28,41 +34,49 @@ func newImageSetMapper(articleToImageSetMApper ArticleToImageSetMapper, attribut
 	}
 }
 
+// Map maps the image-sets of the article, logging the diagnostics and counting the outcome in the metrics.
 func (m defaultImageSetMapper) Map(source NativeContent, lastModified string, publishReference string) ([]JSONImageSet, error) {
+	jsonImageSets, diagnostics, err := m.MapWithDiagnostics(source, lastModified, publishReference)
+	for _, diagnostic := range diagnostics {
+		logEvent(mapEvent, publishReference).WithFields(logrus.Fields{uuidField: source.Uuid, stageField: diagnostic.Stage, "code": diagnostic.Code, "image_set_id": diagnostic.ImageSetID}).Warn(diagnostic.Message)
+	}
+	if err != nil {
+		mappingFailures.WithLabelValues(asMappingError(err, mappingFailedCode, imageSetStage).stage).Inc()
+		return jsonImageSets, err
+	}
+	imageSetsProduced.Add(float64(len(jsonImageSets)))
+	imageSetsPerArticle.Observe(float64(len(jsonImageSets)))
+	return jsonImageSets, nil
+}
+
+// MapWithDiagnostics maps the image-sets of the article. When it fails, the error is a *mappingError and the last
+// diagnostic.
+func (m defaultImageSetMapper) MapWithDiagnostics(source NativeContent, lastModified string, publishReference string) ([]JSONImageSet, []MappingDiagnostic, error) {
 	articleUuid := source.Uuid
 	err := uuidutils.ValidateUUID(articleUuid)
 	if err != nil {
-		msg := fmt.Errorf("No valid UUID found in article. %v\n", err)
-		logrus.Warn(msg)
-		return nil, msg
+		return failMapping(nil, newMappingError(invalidUUIDCode, uuidStage, "uuid", fmt.Errorf("No valid UUID found in article. %v", err)))
 	}
-
 	valueXml, err := base64.StdEncoding.DecodeString(source.Value)
 	if err != nil {
-		msg := fmt.Errorf("Cound't decode string as base64. %v\n", err)
-		logrus.Warn(msg)
-		return nil, msg
+		return failMapping(nil, newMappingError(badBase64Code, bodyStage, "value", fmt.Errorf("Cound't decode string as base64. %v", err)))
 	}
-
 	xmlImageSets, err := m.articleToImageSetMapper.Map(valueXml)
 	if err != nil {
-		msg := fmt.Errorf("Couldn't parse XML document. %v\n", err)
-		logrus.Warn(msg)
-		return nil, msg
+		return failMapping(nil, newMappingError(bodyXMLInvalidCode, bodyStage, "value", fmt.Errorf("Couldn't parse XML document. %v", err)))
 	}
-
 	attributes, err := m.attributesMapper.Map(source.Attributes)
 	if err != nil {
-		msg := fmt.Errorf("Couldn't parse attributes XML. %v\n", err)
-		logrus.Warn(msg)
-		return nil, msg
+		return failMapping(nil, newMappingError(attributesInvalidCode, attributesStage, "attributes", fmt.Errorf("Couldn't parse attributes XML. %v", err)))
 	}
-
-	jsonImageSets, err := m.xmlImageSetToJSONMapper.Map(xmlImageSets, articleUuid, attributes, lastModified, publishReference)
+	jsonImageSets, diagnostics, err := m.xmlImageSetToJSONMapper.Map(xmlImageSets, articleUuid, attributes, lastModified, publishReference)
 	if err != nil {
-		msg := fmt.Errorf("Couldn't map ImageSets from model sourced from XML to model targeted for JSON. %v\n", err)
-		logrus.Error(msg)
-		return nil, msg
+		mappingErr := asMappingError(err, mappingFailedCode, imageSetStage)
+		return failMapping(diagnostics, mappingErr.prefixed("Couldn't map ImageSets from model sourced from XML to model targeted for JSON."))
 	}
-	return jsonImageSets, nil
+	return jsonImageSets, diagnostics, nil
+}
+
+func failMapping(diagnostics []MappingDiagnostic, err *mappingError) ([]JSONImageSet, []MappingDiagnostic, error) {
+	return nil, append(diagnostics, newErrorDiagnostic(err)), err
 }
@@ -60,6 +60,7 @@ func TestISMap_ErrorInvalidUuid(t *testing.T) {
 	source := NativeContent{Uuid: "1234", Type: compoundStory, Value: "PGRvYz48L2RvYz4="}
 	_, err := m.Map(source, "2017-05-17T13:46:01.100Z", "tid_test")
 	assert.Error(t, err, "Error was expected during UUID validation")
+	assert.Equal(t, invalidUUIDCode, err.(*mappingError).code)
 }
 
 func TestISMap_ErrorBase64(t *testing.T) {
@@ -67,6 +68,7 @@ func TestISMap_ErrorBase64(t *testing.T) {
 	source := NativeContent{Uuid: "c17e8abe-1df8-11e7-942c-4a4c42b3072e", Type: compoundStory, Value: "***"}
 	_, err := m.Map(source, "2017-05-17T13:46:01.100Z", "tid_test")
 	assert.Error(t, err, "Error was expected during base64 decoding")
+	assert.Equal(t, badBase64Code, err.(*mappingError).code)
 }
 
 func TestISMap_ErrorXmlMapping(t *testing.T) {
@@ -76,6 +78,7 @@ func TestISMap_ErrorXmlMapping(t *testing.T) {
 	source := NativeContent{Uuid: "c17e8abe-1df8-11e7-942c-4a4c42b3072e", Type: compoundStory, Value: "PGRvYz48L2RvYz4="}
 	_, err := m.Map(source, "2017-05-17T13:46:01.100Z", "tid_test")
 	assert.Error(t, err, "Error was expected during mapping article to xml imageSets")
+	assert.Equal(t, bodyXMLInvalidCode, err.(*mappingError).code)
 }
 
 func TestISMap_ErrorAttributesMapping(t *testing.T) {
@@ -89,6 +92,7 @@ func TestISMap_ErrorAttributesMapping(t *testing.T) {
 	source := NativeContent{Uuid: "c17e8abe-1df8-11e7-942c-4a4c42b3072e", Type: compoundStory, Value: "PGRvYz48L2RvYz4="}
 	_, err := m.Map(source, "2017-05-17T13:46:01.100Z", "tid_test")
 	assert.Error(t, err, "Error was expected during mapping xml attributes")
+	assert.Equal(t, attributesInvalidCode, err.(*mappingError).code)
 }
 
 func TestISMap_ErrorJsonMapping(t *testing.T) {
@@ -102,4 +106,5 @@ func TestISMap_ErrorJsonMapping(t *testing.T) {
 	source := NativeContent{Uuid: "c17e8abe-1df8-11e7-942c-4a4c42b3072e", Type: compoundStory, Value: "PGRvYz48L2RvYz4="}
 	_, err := m.Map(source, "2017-05-17T13:46:01.100Z", "tid_test")
 	assert.Error(t, err, "Error was expected during mapping xml image set to json model")
+	assert.Equal(t, mappingFailedCode, err.(*mappingError).code)
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	imageSetsBucket        = []byte("imageSets")
+	articleImageSetsBucket = []byte("articleImageSets")
+	imageSetOriginsBucket  = []byte("imageSetOrigins")
+)
+
+// imageSetStore keeps the last published version of every image-set, and the image-sets last published for every
+// article in body order, so that they can be looked up after publication. It also keeps the article and the Methode
+// element every image-set was mapped from, as image-set uuids can't be reversed.
+type imageSetStore struct {
+	db *bolt.DB
+}
+
+// imageSetOrigin is where an image-set was mapped from, and when it was mapped first and last.
+type imageSetOrigin struct {
+	ImageSetUUID string `json:"imageSetUuid"`
+	ArticleUUID  string `json:"articleUuid"`
+	MethodeID    string `json:"methodeId"`
+	FirstSeen    string `json:"firstSeen"`
+	LastSeen     string `json:"lastSeen"`
+}
+
+func openImageSetStore(path string) (*imageSetStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't open image-set store path=%v. %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{imageSetsBucket, articleImageSetsBucket, imageSetOriginsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Couldn't create image-set store buckets path=%v. %v", path, err)
+	}
+	return &imageSetStore{db: db}, nil
+}
+
+// openReadOnlyImageSetStore opens an existing store for lookups only. A running service keeps the store locked until
+// it stops, so this fails after timeout unless the store belongs to a stopped service or is a copy.
+func openReadOnlyImageSetStore(path string, timeout time.Duration) (*imageSetStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't open image-set store path=%v, it may be in use by the service. %v", path, err)
+	}
+	return &imageSetStore{db: db}, nil
+}
+
+// mapped records the article and Methode element the image-sets were mapped from, keeping when they were first seen.
+func (s *imageSetStore) mapped(articleUUID string, imageSets []JSONImageSet, seen time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(imageSetOriginsBucket)
+		for _, imageSet := range imageSets {
+			origin := imageSetOrigin{
+				ImageSetUUID: imageSet.UUID,
+				ArticleUUID:  articleUUID,
+				MethodeID:    imageSet.MethodeID,
+				FirstSeen:    seen.UTC().Format(uppDateFormat),
+				LastSeen:     seen.UTC().Format(uppDateFormat),
+			}
+			var stored imageSetOrigin
+			if previous := bucket.Get([]byte(imageSet.UUID)); previous != nil && json.Unmarshal(previous, &stored) == nil {
+				origin.FirstSeen = stored.FirstSeen
+			}
+			marshaled, err := json.Marshal(origin)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(imageSet.UUID), marshaled); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// origin returns where the image-set was mapped from, or nil when it was never mapped.
+func (s *imageSetStore) origin(imageSetUUID string) (*imageSetOrigin, error) {
+	var origin *imageSetOrigin
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(imageSetOriginsBucket)
+		if bucket == nil {
+			return nil
+		}
+		stored := bucket.Get([]byte(imageSetUUID))
+		if stored == nil {
+			return nil
+		}
+		origin = &imageSetOrigin{}
+		return json.Unmarshal(stored, origin)
+	})
+	return origin, err
+}
+
+// published stores the image-sets published for an article, replacing the ones stored for it before.
+func (s *imageSetStore) published(articleUUID string, imageSets []JSONImageSet) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		uuids := make([]string, 0, len(imageSets))
+		for _, imageSet := range imageSets {
+			marshaled, err := json.Marshal(imageSet)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(imageSetsBucket).Put([]byte(imageSet.UUID), marshaled); err != nil {
+				return err
+			}
+			uuids = append(uuids, imageSet.UUID)
+		}
+		marshaled, err := json.Marshal(uuids)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(articleImageSetsBucket).Put([]byte(articleUUID), marshaled)
+	})
+}
+
+// imageSet returns the last published version of an image-set, as it was published. It returns nil when there's none.
+func (s *imageSetStore) imageSet(uuid string) (json.RawMessage, error) {
+	var imageSet json.RawMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if stored := tx.Bucket(imageSetsBucket).Get([]byte(uuid)); stored != nil {
+			imageSet = append(json.RawMessage{}, stored...)
+		}
+		return nil
+	})
+	return imageSet, err
+}
+
+// articleImageSets returns the image-sets last published for an article, in body order. It returns false when nothing
+// was published for the article.
+func (s *imageSetStore) articleImageSets(articleUUID string) ([]json.RawMessage, bool, error) {
+	var imageSets []json.RawMessage
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		stored := tx.Bucket(articleImageSetsBucket).Get([]byte(articleUUID))
+		if stored == nil {
+			return nil
+		}
+		found = true
+		var uuids []string
+		if err := json.Unmarshal(stored, &uuids); err != nil {
+			return err
+		}
+		imageSets = make([]json.RawMessage, 0, len(uuids))
+		for _, uuid := range uuids {
+			if imageSet := tx.Bucket(imageSetsBucket).Get([]byte(uuid)); imageSet != nil {
+				imageSets = append(imageSets, append(json.RawMessage{}, imageSet...))
+			}
+		}
+		return nil
+	})
+	return imageSets, found, err
+}
+
+func (s *imageSetStore) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/message-queue-go-producer/producer"
+	"github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testArticleUUID = "c17e8abe-1df8-11e7-942c-4a4c42b3072e"
+
+func newTestImageSetStore(t *testing.T) (*imageSetStore, func()) {
+	dir, err := ioutil.TempDir("", "imageSetStore")
+	assert.NoError(t, err)
+	store, err := openImageSetStore(filepath.Join(dir, "image-sets.db"))
+	assert.NoError(t, err)
+	return store, func() {
+		store.close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestImageSetStore_ReplacesArticleImageSets(t *testing.T) {
+	store, cleanup := newTestImageSetStore(t)
+	defer cleanup()
+
+	assert.NoError(t, store.published(testArticleUUID, []JSONImageSet{{UUID: "b"}, {UUID: "a"}}))
+	imageSets, found, err := store.articleImageSets(testArticleUUID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []json.RawMessage{json.RawMessage(`{"uuid":"b","identifiers":null,"members":null,"publishReference":"","lastModified":"","publishedDate":"","firstPublishedDate":"","canBeDistributed":"","type":""}`),
+		json.RawMessage(`{"uuid":"a","identifiers":null,"members":null,"publishReference":"","lastModified":"","publishedDate":"","firstPublishedDate":"","canBeDistributed":"","type":""}`)}, imageSets)
+
+	assert.NoError(t, store.published(testArticleUUID, nil))
+	imageSets, found, err = store.articleImageSets(testArticleUUID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Empty(t, imageSets)
+	imageSet, err := store.imageSet("a")
+	assert.NoError(t, err)
+	assert.NotNil(t, imageSet, "Image-sets stay published after they're dropped from the article")
+
+	_, found, err = store.articleImageSets("unknown")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestOnMessage_StoresPublishedImageSets(t *testing.T) {
+	store, cleanup := newTestImageSetStore(t)
+	defer cleanup()
+	mockedProducer := new(mockProducer)
+	q := newTimestampTestQueue(mockedProducer)
+	q.imageSetStore = store
+
+	assert.NoError(t, q.onMessage(articleMessage("2017-05-15T15:54:32.166Z", nil)))
+
+	imageSet, err := store.imageSet("512c1f3d-e48c-4618-863c-94bc9d913b9b")
+	assert.NoError(t, err)
+	assert.Contains(t, string(imageSet), `"uuid":"512c1f3d-e48c-4618-863c-94bc9d913b9b"`)
+}
+
+func TestOnMessage_DoesNotStoreFailedPublication(t *testing.T) {
+	store, cleanup := newTestImageSetStore(t)
+	defer cleanup()
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(assert.AnError)
+	q := newTimestampTestQueue(mockedProducer)
+	q.imageSetStore = store
+
+	assert.Error(t, q.onMessage(consumer.Message{Headers: map[string]string{"X-Request-Id": "tid_test123", "Origin-System-Id": methodeSystemOrigin}}))
+
+	imageSet, err := store.imageSet("512c1f3d-e48c-4618-863c-94bc9d913b9b")
+	assert.NoError(t, err)
+	assert.Nil(t, imageSet)
+}
+
+func TestLookupEndpoints(t *testing.T) {
+	store, cleanup := newTestImageSetStore(t)
+	defer cleanup()
+	assert.NoError(t, store.published(testArticleUUID, []JSONImageSet{{UUID: "4ec94836-0d00-325d-9005-c9aa67f68963", PublishReference: "tid_test"}}))
+	assert.NoError(t, store.mapped(testArticleUUID, []JSONImageSet{{UUID: "4ec94836-0d00-325d-9005-c9aa67f68963", MethodeID: "U11603507121721xBE"}}, time.Now()))
+	r := newRouting(newHTTPMappingHandler(nil, nil, nil), newBatchMappingHandler(nil, nil, 0, 1), newValidationHandler(nil, nil), newDiffHandler(nil, nil),
+		newImageSetLookupHandler(store), nil, nil, initializeHealthCheck(true, true))
+	server := httptest.NewServer(r.router)
+	defer server.Close()
+
+	tests := []struct {
+		path         string
+		expectedCode int
+		expectedBody string
+	}{
+		{"/image-sets/4ec94836-0d00-325d-9005-c9aa67f68963", http.StatusOK, `"publishReference":"tid_test"`},
+		{"/image-sets/8c07916c-2577-37b6-b477-291094f992ee", http.StatusNotFound, `{"message":"No image-set was published with uuid=8c07916c-2577-37b6-b477-291094f992ee.","code":"NOT_FOUND","stage":"store","field":"uuid"`},
+		{"/articles/" + testArticleUUID + "/image-sets", http.StatusOK, `[{"uuid":"4ec94836-0d00-325d-9005-c9aa67f68963"`},
+		{"/articles/8c07916c-2577-37b6-b477-291094f992ee/image-sets", http.StatusNotFound, `{"message":"Nothing was published for article uuid=8c07916c-2577-37b6-b477-291094f992ee.","code":"NOT_FOUND","stage":"store","field":"uuid"`},
+		{"/image-sets/4ec94836-0d00-325d-9005-c9aa67f68963/origin", http.StatusOK, `{"imageSetUuid":"4ec94836-0d00-325d-9005-c9aa67f68963","articleUuid":"c17e8abe-1df8-11e7-942c-4a4c42b3072e","methodeId":"U11603507121721xBE",`},
+		{"/image-sets/8c07916c-2577-37b6-b477-291094f992ee/origin", http.StatusNotFound, `{"message":"No image-set was mapped with uuid=8c07916c-2577-37b6-b477-291094f992ee.","code":"NOT_FOUND","stage":"store","field":"uuid"`},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(server.URL + test.path)
+		assert.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, test.expectedCode, resp.StatusCode, test.path)
+		assert.Contains(t, string(body), test.expectedBody, test.path)
+	}
+}
+
+func TestImageSetStore_RecordsOriginsOfMappings(t *testing.T) {
+	store, cleanup := newTestImageSetStore(t)
+	defer cleanup()
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(assert.AnError)
+	q := newTimestampTestQueue(mockedProducer)
+	q.imageSetStore = store
+	first := time.Date(2017, 5, 15, 15, 54, 32, 0, time.UTC)
+	assert.NoError(t, store.mapped(testArticleUUID, []JSONImageSet{{UUID: "512c1f3d-e48c-4618-863c-94bc9d913b9b", MethodeID: "U11603507121721xBE"}}, first))
+
+	assert.Error(t, q.onMessage(articleMessage("2017-05-16T15:54:32.166Z", nil)), "Mappings are recorded even when they can't be published")
+
+	origin, err := store.origin("512c1f3d-e48c-4618-863c-94bc9d913b9b")
+	assert.NoError(t, err)
+	assert.Equal(t, "512c1f3d-e48c-4618-863c-94bc9d913b9b", origin.ImageSetUUID)
+	assert.Equal(t, testArticleUUID, origin.ArticleUUID)
+	assert.Equal(t, "", origin.MethodeID, "The mocked mapper has no Methode id")
+	assert.Equal(t, "2017-05-15T15:54:32.000Z", origin.FirstSeen)
+	assert.NotEqual(t, origin.FirstSeen, origin.LastSeen)
+
+	origin, err = store.origin("8c07916c-2577-37b6-b477-291094f992ee")
+	assert.NoError(t, err)
+	assert.Nil(t, origin)
+}
+
+func TestPrintOrigins(t *testing.T) {
+	store, cleanup := newTestImageSetStore(t)
+	defer cleanup()
+	seen := time.Date(2017, 5, 15, 15, 54, 32, 0, time.UTC)
+	assert.NoError(t, store.mapped(testArticleUUID, []JSONImageSet{{UUID: "4ec94836-0d00-325d-9005-c9aa67f68963", MethodeID: "U11603507121721xBE"}}, seen))
+
+	out := new(bytes.Buffer)
+	missing := printOrigins(store.origin, []string{"4ec94836-0d00-325d-9005-c9aa67f68963", "8c07916c-2577-37b6-b477-291094f992ee"}, out)
+
+	assert.Equal(t, 1, missing)
+	assert.Equal(t, `{"imageSetUuid":"4ec94836-0d00-325d-9005-c9aa67f68963","articleUuid":"c17e8abe-1df8-11e7-942c-4a4c42b3072e","methodeId":"U11603507121721xBE","firstSeen":"2017-05-15T15:54:32.000Z","lastSeen":"2017-05-15T15:54:32.000Z"}`+"\n", out.String())
+}
+
+func TestPrintOrigins_FromService(t *testing.T) {
+	store, cleanup := newTestImageSetStore(t)
+	defer cleanup()
+	seen := time.Date(2017, 5, 15, 15, 54, 32, 0, time.UTC)
+	assert.NoError(t, store.mapped(testArticleUUID, []JSONImageSet{{UUID: "4ec94836-0d00-325d-9005-c9aa67f68963", MethodeID: "U11603507121721xBE"}}, seen))
+	r := newRouting(newHTTPMappingHandler(nil, nil, nil), newBatchMappingHandler(nil, nil, 0, 1), newValidationHandler(nil, nil), newDiffHandler(nil, nil),
+		newImageSetLookupHandler(store), nil, nil, initializeHealthCheck(true, true))
+	server := httptest.NewServer(r.router)
+	defer server.Close()
+
+	out := new(bytes.Buffer)
+	missing := printOrigins(serviceOrigin(http.DefaultClient, server.URL+"/"), []string{"4ec94836-0d00-325d-9005-c9aa67f68963", "8c07916c-2577-37b6-b477-291094f992ee"}, out)
+
+	assert.Equal(t, 1, missing)
+	assert.Equal(t, `{"imageSetUuid":"4ec94836-0d00-325d-9005-c9aa67f68963","articleUuid":"c17e8abe-1df8-11e7-942c-4a4c42b3072e","methodeId":"U11603507121721xBE","firstSeen":"2017-05-15T15:54:32.000Z","lastSeen":"2017-05-15T15:54:32.000Z"}`+"\n", out.String())
+}
+
+func TestServiceOrigin_FailsOnUnexpectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	origin, err := serviceOrigin(http.DefaultClient, server.URL)("4ec94836-0d00-325d-9005-c9aa67f68963")
+
+	assert.Error(t, err)
+	assert.Nil(t, origin)
+}
+
+func TestOpenReadOnlyImageSetStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageSetStore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "image-sets.db")
+	store, err := openImageSetStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, store.mapped(testArticleUUID, []JSONImageSet{{UUID: "4ec94836-0d00-325d-9005-c9aa67f68963"}}, time.Now()))
+
+	_, err = openReadOnlyImageSetStore(path, 10*time.Millisecond)
+	assert.Error(t, err, "The store is in use")
+
+	assert.NoError(t, store.close())
+	readOnly, err := openReadOnlyImageSetStore(path, 10*time.Millisecond)
+	assert.NoError(t, err)
+	defer readOnly.close()
+	origin, err := readOnly.origin("4ec94836-0d00-325d-9005-c9aa67f68963")
+	assert.NoError(t, err)
+	assert.Equal(t, testArticleUUID, origin.ArticleUUID)
+}
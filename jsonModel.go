@@ -10,6 +10,9 @@ type JSONImageSet struct {
 	FirstPublishedDate string           `json:"firstPublishedDate"`
 	CanBeDistributed   string           `json:"canBeDistributed"`
 	Type               string           `json:"type"`
+	// MethodeID is the id attribute of the image-set element in the article body. It isn't part of the image-set
+	// model, it's only kept to relate the image-set back to its article.
+	MethodeID string `json:"-"`
 }
 
 type JSONMember struct {
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+)
+
+const ftMessageVersionLine = "FTMSG/1.0"
+
+// kafkaConsumer reads messages straight from the kafka brokers as a member of a consumer group. Like proxyConsumer
+// it commits the offset of a message only after the handler processed it successfully. When handling fails the
+// session is ended, so the group is joined again and consumption resumes from the last committed offset.
+type kafkaConsumer struct {
+	brokers  []string
+	group    string
+	topic    string
+	config   *sarama.Config
+	handler  func(m consumer.Message) error
+	backoff  time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+
+	sync.RWMutex
+	client sarama.Client
+}
+
+func newKafkaConsumer(brokers []string, group string, topic string, config *sarama.Config, handler func(m consumer.Message) error) *kafkaConsumer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kafkaConsumer{
+		brokers: brokers,
+		group:   group,
+		topic:   topic,
+		config:  config,
+		handler: handler,
+		backoff: defaultBackoffPeriod,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (c *kafkaConsumer) Start() {
+	consumerGroup := c.connect()
+	if consumerGroup == nil {
+		return
+	}
+	go c.logErrors(consumerGroup)
+	for c.ctx.Err() == nil {
+		err := consumerGroup.Consume(c.ctx, []string{c.topic}, c)
+		if err != nil && c.ctx.Err() == nil {
+			logEvent(queueEvent, "").WithFields(logrus.Fields{"topic": c.topic, "group": c.group}).WithError(err).Error("Error consuming from kafka.")
+			c.waitBackoff()
+		}
+	}
+	err := consumerGroup.Close()
+	if err != nil {
+		logEvent(queueEvent, "").WithField("group", c.group).WithError(err).Warn("Couldn't close kafka consumer group.")
+	}
+	c.Lock()
+	defer c.Unlock()
+	err = c.client.Close()
+	if err != nil {
+		logEvent(queueEvent, "").WithError(err).Warn("Couldn't close kafka client.")
+	}
+	c.client = nil
+}
+
+// Stop ends the group session, only the first time it is called.
+func (c *kafkaConsumer) Stop() {
+	c.stopOnce.Do(c.cancel)
+}
+
+func (c *kafkaConsumer) ConnectivityCheck() (string, error) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.client == nil {
+		return "Error connecting to kafka", fmt.Errorf("Not connected to kafka brokers %v", c.brokers)
+	}
+	err := c.client.RefreshMetadata(c.topic)
+	if err != nil {
+		return "Error connecting to kafka", err
+	}
+	return "Connectivity to kafka is OK.", nil
+}
+
+// connect keeps trying to reach the brokers until it succeeds or the consumer is stopped, in which case it returns nil.
+func (c *kafkaConsumer) connect() sarama.ConsumerGroup {
+	for c.ctx.Err() == nil {
+		client, err := sarama.NewClient(c.brokers, c.config)
+		if err != nil {
+			logEvent(queueEvent, "").WithField("brokers", c.brokers).WithError(err).Error("Couldn't connect to kafka.")
+			c.waitBackoff()
+			continue
+		}
+		consumerGroup, err := sarama.NewConsumerGroupFromClient(c.group, client)
+		if err != nil {
+			logEvent(queueEvent, "").WithField("group", c.group).WithError(err).Error("Couldn't create kafka consumer group.")
+			client.Close()
+			c.waitBackoff()
+			continue
+		}
+		c.Lock()
+		c.client = client
+		c.Unlock()
+		return consumerGroup
+	}
+	return nil
+}
+
+func (c *kafkaConsumer) logErrors(consumerGroup sarama.ConsumerGroup) {
+	for err := range consumerGroup.Errors() {
+		logEvent(queueEvent, "").WithField("group", c.group).WithError(err).Error("Error in kafka consumer group.")
+	}
+}
+
+func (c *kafkaConsumer) waitBackoff() {
+	select {
+	case <-c.ctx.Done():
+	case <-time.After(c.backoff):
+	}
+}
+
+func (c *kafkaConsumer) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (c *kafkaConsumer) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (c *kafkaConsumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for kafkaMsg := range claim.Messages() {
+		msg, err := fromKafkaMessage(kafkaMsg)
+		if err != nil {
+			logEvent(consumeEvent, "").WithFields(logrus.Fields{"partition": kafkaMsg.Partition, "offset": kafkaMsg.Offset}).WithError(err).Warn("Skipping message that couldn't be parsed.")
+			session.MarkMessage(kafkaMsg, "")
+			session.Commit()
+			continue
+		}
+		err = c.handler(msg)
+		if err != nil {
+			c.waitBackoff()
+			return fmt.Errorf("Message couldn't be processed, offset won't be committed and it will be consumed again partition=%v offset=%v. %v", kafkaMsg.Partition, kafkaMsg.Offset, err)
+		}
+		session.MarkMessage(kafkaMsg, "")
+		session.Commit()
+	}
+	return nil
+}
+
+// fromKafkaMessage maps the record headers of a kafka message to message headers. Messages without record headers
+// are expected to carry them in the FTMSG/1.0 envelope, as the ones written through the queue proxy do.
+func fromKafkaMessage(kafkaMsg *sarama.ConsumerMessage) (consumer.Message, error) {
+	if len(kafkaMsg.Headers) == 0 {
+		if strings.HasPrefix(string(kafkaMsg.Value), ftMessageVersionLine) {
+			return parseFTMessage(string(kafkaMsg.Value))
+		}
+		return consumer.Message{Headers: map[string]string{}, Body: string(kafkaMsg.Value)}, nil
+	}
+	headers := make(map[string]string, len(kafkaMsg.Headers))
+	for _, header := range kafkaMsg.Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+	body := string(kafkaMsg.Value)
+	if strings.HasPrefix(body, ftMessageVersionLine) {
+		enveloped, err := parseFTMessage(body)
+		if err != nil {
+			return consumer.Message{}, err
+		}
+		body = enveloped.Body
+	}
+	return consumer.Message{Headers: headers, Body: body}, nil
+}
+
+// newKafkaConfig returns the sarama configuration shared by the kafka consumer and producer. Offsets are only
+// committed explicitly, and record headers need at least kafka 0.11.
+func newKafkaConfig(clientID string) *sarama.Config {
+	config := sarama.NewConfig()
+	config.ClientID = clientID
+	config.Version = sarama.V0_11_0_0
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	config.Consumer.Offsets.AutoCommit.Enable = false
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	return config
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testKafkaGroup = "methode-article-image-set-mapper"
+	testKafkaTopic = "NativeCmsPublicationEvents"
+)
+
+// newMockKafka returns a broker holding the given messages on partition 0 of the read topic and assigning that
+// partition to whoever joins the group. Fetched offsets are given by committedOffsets, one per join.
+func newMockKafka(t *testing.T, messages []string, committedOffsets ...int64) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	fetch := sarama.NewMockFetchResponse(t, 1).SetVersion(4)
+	for offset, message := range messages {
+		fetch.SetMessage(testKafkaTopic, 0, int64(offset), sarama.StringEncoder(message))
+	}
+	fetch.SetHighWaterMark(testKafkaTopic, 0, int64(len(messages)))
+	offsetFetches := make([]interface{}, 0, len(committedOffsets))
+	for _, committed := range committedOffsets {
+		offsetFetches = append(offsetFetches, sarama.NewMockOffsetFetchResponse(t).SetOffset(testKafkaGroup, testKafkaTopic, 0, committed, "", sarama.ErrNoError))
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(testKafkaTopic, 0, broker.BrokerID()).
+			SetController(broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, testKafkaGroup, broker),
+		"JoinGroupRequest": sarama.NewMockJoinGroupResponse(t).
+			SetGroupProtocol(sarama.BalanceStrategyRange.Name()).
+			SetMemberId("member-1").
+			SetLeaderId("member-0"),
+		"SyncGroupRequest": sarama.NewMockSyncGroupResponse(t).
+			SetMemberAssignment(&sarama.ConsumerGroupMemberAssignment{Topics: map[string][]int32{testKafkaTopic: {0}}}),
+		"OffsetFetchRequest": sarama.NewMockSequence(offsetFetches...),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset(testKafkaTopic, 0, sarama.OffsetOldest, 0).
+			SetOffset(testKafkaTopic, 0, sarama.OffsetNewest, int64(len(messages))),
+		"FetchRequest":        fetch,
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"HeartbeatRequest":    sarama.NewMockHeartbeatResponse(t),
+		"LeaveGroupRequest":   sarama.NewMockLeaveGroupResponse(t),
+	})
+	return broker
+}
+
+func committedKafkaOffsets(broker *sarama.MockBroker) []int64 {
+	var offsets []int64
+	for _, rr := range broker.History() {
+		commit, ok := rr.Request.(*sarama.OffsetCommitRequest)
+		if !ok {
+			continue
+		}
+		offset, _, err := commit.Offset(testKafkaTopic, 0)
+		if err == nil {
+			offsets = append(offsets, offset)
+		}
+	}
+	return offsets
+}
+
+func newTestKafkaConsumer(broker *sarama.MockBroker, handler func(m consumer.Message) error) *kafkaConsumer {
+	config := newKafkaConfig("methode-article-image-set-mapper")
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	c := newKafkaConsumer([]string{broker.Addr()}, testKafkaGroup, testKafkaTopic, config, handler)
+	c.backoff = 10 * time.Millisecond
+	return c
+}
+
+func runKafkaConsumerUntil(c *kafkaConsumer, condition func() bool) {
+	done := make(chan struct{})
+	go func() {
+		c.Start()
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Stop()
+	<-done
+}
+
+// failingOnceHandler records every body it gets and fails only the first time it gets failOn.
+type failingOnceHandler struct {
+	recordingHandler
+	failed bool
+}
+
+func (h *failingOnceHandler) handle(m consumer.Message) error {
+	h.Lock()
+	defer h.Unlock()
+	h.bodies = append(h.bodies, m.Body)
+	if m.Body == h.failOn && !h.failed {
+		h.failed = true
+		return errors.New("couldn't send image-sets")
+	}
+	return nil
+}
+
+func TestKafkaConsumer_CommitsAfterEachHandledMessage(t *testing.T) {
+	broker := newMockKafka(t, []string{"FTMSG/1.0\r\nX-Request-Id: tid_1\r\n\r\narticle-1", "FTMSG/1.0\r\nX-Request-Id: tid_2\r\n\r\narticle-2"}, 0)
+	defer broker.Close()
+
+	handler := &recordingHandler{}
+	runKafkaConsumerUntil(newTestKafkaConsumer(broker, handler.handle), func() bool { return len(committedKafkaOffsets(broker)) == 2 })
+
+	assert.Equal(t, []string{"article-1", "article-2"}, handler.handled())
+	assert.Equal(t, []int64{1, 2}, committedKafkaOffsets(broker))
+}
+
+func TestKafkaConsumer_RedeliversAfterFailedProcessing(t *testing.T) {
+	broker := newMockKafka(t, []string{"article-1", "article-2"}, 0, 1)
+	defer broker.Close()
+
+	handler := &failingOnceHandler{recordingHandler: recordingHandler{failOn: "article-2"}}
+	runKafkaConsumerUntil(newTestKafkaConsumer(broker, handler.handle), func() bool {
+		committed := committedKafkaOffsets(broker)
+		return len(committed) != 0 && committed[len(committed)-1] == 2
+	})
+
+	assert.Equal(t, []string{"article-1", "article-2", "article-2"}, handler.handled(), "Only the failed article should be consumed again")
+	assert.Equal(t, []int64{1, 2}, committedKafkaOffsets(broker), "The failed article shouldn't be committed until it's processed")
+}
+
+func TestKafkaConsumer_StopTwice(t *testing.T) {
+	c := newKafkaConsumer([]string{"localhost:9092"}, testKafkaGroup, testKafkaTopic, newKafkaConfig("methode-article-image-set-mapper"), nil)
+	c.Stop()
+
+	assert.NotPanics(t, c.Stop)
+	assert.Error(t, c.ctx.Err())
+}
+
+func TestKafkaConsumer_ConnectivityCheck(t *testing.T) {
+	broker := newMockKafka(t, nil, 0)
+	defer broker.Close()
+
+	c := newTestKafkaConsumer(broker, (&recordingHandler{}).handle)
+	_, err := c.ConnectivityCheck()
+	assert.Error(t, err, "Shouldn't be connected before starting")
+
+	var message string
+	runKafkaConsumerUntil(c, func() bool {
+		message, err = c.ConnectivityCheck()
+		return err == nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Connectivity to kafka is OK.", message)
+}
+
+func TestFromKafkaMessage_RecordHeaders(t *testing.T) {
+	msg, err := fromKafkaMessage(&sarama.ConsumerMessage{
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("X-Request-Id"), Value: []byte("tid_test")},
+			{Key: []byte("Origin-System-Id"), Value: []byte(methodeSystemOrigin)},
+		},
+		Value: []byte(`{"uuid":"c17e8abe-1df8-11e7-942c-4a4c42b3072e"}`),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"X-Request-Id": "tid_test", "Origin-System-Id": methodeSystemOrigin}, msg.Headers)
+	assert.Equal(t, `{"uuid":"c17e8abe-1df8-11e7-942c-4a4c42b3072e"}`, msg.Body)
+}
+
+func TestFromKafkaMessage_EnvelopeWithoutRecordHeaders(t *testing.T) {
+	msg, err := fromKafkaMessage(&sarama.ConsumerMessage{
+		Value: []byte("FTMSG/1.0\r\nX-Request-Id: tid_test\r\n\r\n{\"uuid\":\"c17e8abe-1df8-11e7-942c-4a4c42b3072e\"}"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "tid_test", msg.Headers["X-Request-Id"])
+	assert.Equal(t, `{"uuid":"c17e8abe-1df8-11e7-942c-4a4c42b3072e"}`, msg.Body)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Financial-Times/message-queue-go-producer/producer"
+	"github.com/Shopify/sarama"
+)
+
+// kafkaProducer sends messages straight to the kafka brokers. The message is written in the FTMSG/1.0 envelope,
+// so consumers reading through the queue proxy still understand it, and its headers are also set as record headers.
+type kafkaProducer struct {
+	brokers []string
+	topic   string
+	config  *sarama.Config
+
+	sync.Mutex
+	client       sarama.Client
+	syncProducer sarama.SyncProducer
+}
+
+func newKafkaProducer(brokers []string, topic string, config *sarama.Config) *kafkaProducer {
+	return &kafkaProducer{
+		brokers: brokers,
+		topic:   topic,
+		config:  config,
+	}
+}
+
+func (p *kafkaProducer) SendMessage(key string, msg producer.Message) error {
+	syncProducer, err := p.connect()
+	if err != nil {
+		return err
+	}
+	kafkaMsg := &sarama.ProducerMessage{
+		Topic:   p.topic,
+		Value:   sarama.StringEncoder(formatFTMessage(msg)),
+		Headers: toRecordHeaders(msg.Headers),
+	}
+	if key != "" {
+		kafkaMsg.Key = sarama.StringEncoder(key)
+	}
+	_, _, err = syncProducer.SendMessage(kafkaMsg)
+	if err != nil {
+		return fmt.Errorf("Couldn't send message to kafka topic=%v. %v", p.topic, err)
+	}
+	return nil
+}
+
+func (p *kafkaProducer) ConnectivityCheck() (string, error) {
+	_, err := p.connect()
+	if err != nil {
+		return "Error connecting to kafka", err
+	}
+	p.Lock()
+	defer p.Unlock()
+	err = p.client.RefreshMetadata(p.topic)
+	if err != nil {
+		return "Error connecting to kafka", err
+	}
+	return "Connectivity to kafka is OK.", nil
+}
+
+func (p *kafkaProducer) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.syncProducer == nil {
+		return nil
+	}
+	err := p.syncProducer.Close()
+	p.client.Close()
+	p.syncProducer = nil
+	p.client = nil
+	return err
+}
+
+// connect reaches the brokers on first use, so the service can start while kafka isn't available yet.
+func (p *kafkaProducer) connect() (sarama.SyncProducer, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.syncProducer != nil {
+		return p.syncProducer, nil
+	}
+	client, err := sarama.NewClient(p.brokers, p.config)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't connect to kafka brokers=%v. %v", p.brokers, err)
+	}
+	syncProducer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Couldn't create kafka producer. %v", err)
+	}
+	p.client = client
+	p.syncProducer = syncProducer
+	return syncProducer, nil
+}
+
+func toRecordHeaders(headers map[string]string) []sarama.RecordHeader {
+	keys := sortedKeys(headers)
+	recordHeaders := make([]sarama.RecordHeader, 0, len(keys))
+	for _, key := range keys {
+		recordHeaders = append(recordHeaders, sarama.RecordHeader{Key: []byte(key), Value: []byte(headers[key])})
+	}
+	return recordHeaders
+}
+
+// formatFTMessage writes a message in the FTMSG/1.0 envelope read by parseFTMessage.
+func formatFTMessage(msg producer.Message) string {
+	envelope := ftMessageVersionLine + "\r\n"
+	for _, key := range sortedKeys(msg.Headers) {
+		envelope += key + ": " + msg.Headers[key] + "\r\n"
+	}
+	return envelope + "\r\n" + msg.Body
+}
+
+func sortedKeys(headers map[string]string) []string {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
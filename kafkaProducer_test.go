@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Financial-Times/message-queue-go-producer/producer"
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+const testKafkaWriteTopic = "CmsPublicationEvents"
+
+func newMockKafkaForProducer(t *testing.T, produceErr sarama.KError) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(testKafkaWriteTopic, 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).
+			SetVersion(3).
+			SetError(testKafkaWriteTopic, 0, produceErr),
+	})
+	return broker
+}
+
+func newTestKafkaProducer(broker *sarama.MockBroker) *kafkaProducer {
+	config := newKafkaConfig("methode-article-image-set-mapper")
+	config.Producer.Retry.Max = 0
+	return newKafkaProducer([]string{broker.Addr()}, testKafkaWriteTopic, config)
+}
+
+func TestKafkaProducer_SendMessage(t *testing.T) {
+	broker := newMockKafkaForProducer(t, sarama.ErrNoError)
+	defer broker.Close()
+	p := newTestKafkaProducer(broker)
+	defer p.Close()
+
+	err := p.SendMessage("c17e8abe-1df8-11e7-942c-4a4c42b3072e", producer.Message{
+		Headers: map[string]string{"X-Request-Id": "tid_test", "Message-Type": "cms-content-published"},
+		Body:    `{"contentUri":"http://methode-article-image-set-mapper.svc.ft.com/image-set/model/c17e8abe-1df8-11e7-942c-4a4c42b3072e"}`,
+	})
+	assert.NoError(t, err)
+
+	var produced *sarama.ProduceRequest
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			produced = req
+		}
+	}
+	assert.NotNil(t, produced, "A message should be produced to kafka")
+}
+
+func TestKafkaProducer_SendMessageFails(t *testing.T) {
+	broker := newMockKafkaForProducer(t, sarama.ErrNotEnoughReplicas)
+	defer broker.Close()
+	p := newTestKafkaProducer(broker)
+	defer p.Close()
+
+	err := p.SendMessage("", producer.Message{Headers: map[string]string{}, Body: "{}"})
+	assert.Error(t, err)
+}
+
+func TestKafkaProducer_ConnectivityCheck(t *testing.T) {
+	broker := newMockKafkaForProducer(t, sarama.ErrNoError)
+	defer broker.Close()
+	p := newTestKafkaProducer(broker)
+	defer p.Close()
+
+	message, err := p.ConnectivityCheck()
+	assert.NoError(t, err)
+	assert.Equal(t, "Connectivity to kafka is OK.", message)
+}
+
+func TestKafkaProducer_ConnectivityCheckFails(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	addr := broker.Addr()
+	broker.Close()
+	config := newKafkaConfig("methode-article-image-set-mapper")
+	config.Metadata.Retry.Max = 0
+
+	_, err := newKafkaProducer([]string{addr}, testKafkaWriteTopic, config).ConnectivityCheck()
+	assert.Error(t, err)
+}
+
+func TestFormatFTMessage(t *testing.T) {
+	raw := formatFTMessage(producer.Message{
+		Headers: map[string]string{"X-Request-Id": "tid_test", "Content-Type": "application/json"},
+		Body:    `{"uuid":"c17e8abe-1df8-11e7-942c-4a4c42b3072e"}`,
+	})
+	assert.Equal(t, "FTMSG/1.0\r\nContent-Type: application/json\r\nX-Request-Id: tid_test\r\n\r\n{\"uuid\":\"c17e8abe-1df8-11e7-942c-4a4c42b3072e\"}", raw)
+
+	msg, err := parseFTMessage(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"X-Request-Id": "tid_test", "Content-Type": "application/json"}, msg.Headers)
+	assert.Equal(t, `{"uuid":"c17e8abe-1df8-11e7-942c-4a4c42b3072e"}`, msg.Body)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const logLevelPath = "/__log-level"
+
+// Fields every log line about an article, a request or a message uses for the same thing.
+const (
+	serviceNameField   = "service_name"
+	transactionIDField = "transaction_id"
+	uuidField          = "uuid"
+	eventField         = "event"
+	stageField         = "stage"
+)
+
+// Events of the pipeline, as the event field of its log lines.
+const (
+	consumeEvent   = "consume"
+	mapEvent       = "map"
+	sendEvent      = "send"
+	relationsEvent = "relations"
+	storeEvent     = "store"
+	requestEvent   = "request"
+	replayEvent    = "replay"
+	logLevelEvent  = "log-level"
+	queueEvent     = "queue"
+	serviceEvent   = "service"
+)
+
+// serviceFormatter adds the service name to every line before formatting it.
+type serviceFormatter struct {
+	logrus.Formatter
+	serviceName string
+}
+
+func (f serviceFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(entry.Data)+1)
+	for name, value := range entry.Data {
+		data[name] = value
+	}
+	data[serviceNameField] = f.serviceName
+	withService := *entry
+	withService.Data = data
+	return f.Formatter.Format(&withService)
+}
+
+// configureLogging logs JSON lines naming the service, from the given level on.
+func configureLogging(serviceName string, level string) error {
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetFormatter(serviceFormatter{Formatter: &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}, serviceName: serviceName})
+	logrus.SetLevel(parsed)
+	return nil
+}
+
+// logEvent returns the log entry of an event of the pipeline, for the transaction if there's one.
+func logEvent(event string, tid string) *logrus.Entry {
+	if tid == "" {
+		return logrus.WithField(eventField, event)
+	}
+	return logrus.WithFields(logrus.Fields{eventField: event, transactionIDField: tid})
+}
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// logLevelHandler reads and changes the level of the logs while the service runs.
+type logLevelHandler struct{}
+
+func (h logLevelHandler) get(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json;charset=utf-8")
+	h.writeLevel(w)
+}
+
+func (h logLevelHandler) set(w http.ResponseWriter, r *http.Request) {
+	defer closeRequestBody(r)
+	w.Header().Add("Content-Type", "application/json;charset=utf-8")
+	var body logLevelBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, newMappingError(invalidRequestCode, requestStage, "body", fmt.Errorf("Couldn't read the log level. %v", err)), "")
+		return
+	}
+	level, err := logrus.ParseLevel(body.Level)
+	if err != nil {
+		writeError(w, newMappingError(invalidRequestCode, requestStage, "level", err), "")
+		return
+	}
+	previous := logrus.GetLevel()
+	logrus.SetLevel(level)
+	logEvent(logLevelEvent, "").WithFields(logrus.Fields{"from": previous.String(), "to": level.String()}).Info("Changed the log level.")
+	h.writeLevel(w)
+}
+
+func (h logLevelHandler) writeLevel(w http.ResponseWriter) {
+	marshaled, err := json.Marshal(logLevelBody{Level: logrus.GetLevel().String()})
+	if err != nil {
+		logEvent(logLevelEvent, "").WithError(err).Warn("Couldn't marshall log level to JSON.")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(marshaled)
+	if err != nil {
+		logEvent(logLevelEvent, "").WithError(err).Warn("Couldn't write to response.")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingFormatter struct {
+	entries []*logrus.Entry
+}
+
+func (f *recordingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	f.entries = append(f.entries, entry)
+	return nil, nil
+}
+
+func TestServiceFormatter_AddsServiceName(t *testing.T) {
+	recorder := &recordingFormatter{}
+	entry := logEvent(mapEvent, "tid_test").WithField(uuidField, testArticleUUID)
+
+	_, err := serviceFormatter{Formatter: recorder, serviceName: "methode-article-image-set-mapper"}.Format(entry)
+
+	assert.NoError(t, err)
+	assert.Len(t, recorder.entries, 1)
+	assert.Equal(t, logrus.Fields{
+		serviceNameField:   "methode-article-image-set-mapper",
+		eventField:         mapEvent,
+		transactionIDField: "tid_test",
+		uuidField:          testArticleUUID,
+	}, recorder.entries[0].Data)
+	assert.NotContains(t, entry.Data, serviceNameField, "The logged entry shouldn't be changed")
+}
+
+func TestConfigureLogging_RejectsUnknownLevel(t *testing.T) {
+	assert.Error(t, configureLogging("methode-article-image-set-mapper", "verbose"))
+}
+
+func requestLogLevel(t *testing.T, method string, body string) *httptest.ResponseRecorder {
+	request, err := http.NewRequest(method, logLevelPath, bytes.NewReader([]byte(body)))
+	assert.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	handler := logLevelHandler{}
+	if method == "PUT" {
+		http.HandlerFunc(handler.set).ServeHTTP(recorder, request)
+	} else {
+		http.HandlerFunc(handler.get).ServeHTTP(recorder, request)
+	}
+	return recorder
+}
+
+func TestLogLevelHandler_ChangesLevel(t *testing.T) {
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.InfoLevel)
+
+	recorder := requestLogLevel(t, "PUT", `{"level":"debug"}`)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"level":"debug"}`, recorder.Body.String())
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+	assert.JSONEq(t, `{"level":"debug"}`, requestLogLevel(t, "GET", "").Body.String())
+}
+
+func TestLogLevelHandler_RejectsUnknownLevel(t *testing.T) {
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.InfoLevel)
+
+	recorder := requestLogLevel(t, "PUT", `{"level":"verbose"}`)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"code":"INVALID_REQUEST","stage":"request","field":"level"`)
+	assert.Equal(t, logrus.InfoLevel, logrus.GetLevel())
+}
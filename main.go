@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/Financial-Times/message-queue-go-producer/producer"
 	"github.com/Financial-Times/message-queue-gonsumer/consumer"
@@ -10,70 +11,58 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
+const (
+	proxyQueueBackend = "proxy"
+	kafkaQueueBackend = "kafka"
+)
+
 type app struct {
-	args  args
-	queue defaultQueue
+	args        args
+	queue       *defaultQueue
+	healthCheck *HealthCheck
+	routing     *routing
 }
 
 func main() {
-	logrus.SetLevel(logrus.DebugLevel)
 	cliApp := cli.App("methode-article-image-set-mapper", "Maps inline image-sets from bodies of Methode articles.")
 	a := app{}
-	a.args = resolveArgs(cliApp)
-	cliApp.Action = func() {
-		if len(a.args.addresses) == 0 {
-			logrus.Fatal("No queue address provided. Quitting...")
-		}
-		logrus.Infof("methode-article-image-set-mapper is starting systemCode=%s appName=%s port=%s", a.args.appSystemCode, a.args.appName, a.args.port)
-		messageToNativeMapper := defaultMessageToNativeMapper{}
-		imageSetMapper := newImageSetMapper(defaultArticleToImageSetMapper{}, defaultAttributesMapper{}, defaultImageSetToJSONMapper{})
-		httpClient := http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				DialContext: (&net.Dialer{
-					Timeout:   30 * time.Second,
-					KeepAlive: 30 * time.Second,
-				}).DialContext,
-				MaxIdleConnsPerHost:   20,
-				TLSHandshakeTimeout:   3 * time.Second,
-				ExpectContinueTimeout: 1 * time.Second,
-			},
-		}
-		consumerConfig := consumer.QueueConfig{
-			Addrs:                a.args.addresses,
-			Group:                a.args.group,
-			Topic:                a.args.readTopic,
-			Queue:                a.args.readQueue,
-			ConcurrentProcessing: false,
-			AutoCommitEnable:     true,
-			AuthorizationKey:     a.args.authorization,
+	parsedArgs := resolveArgs(cliApp)
+	cliApp.Before = func() {
+		a.args = parsedArgs()
+		if err := configureLogging(a.args.appSystemCode, a.args.logLevel); err != nil {
+			logEvent(serviceEvent, "").WithError(err).Fatal("Couldn't configure logging. Quitting...")
 		}
-		producerConfig := producer.MessageProducerConfig{
-			Addr:          a.args.addresses[0],
-			Topic:         a.args.writeTopic,
-			Queue:         a.args.writeQueue,
-			Authorization: a.args.authorization,
-		}
-		prettyPrintConfig(consumerConfig, producerConfig)
-		messageProducer := producer.NewMessageProducerWithHTTPClient(producerConfig, &httpClient)
-		a.queue = newQueue(nil, messageProducer, messageToNativeMapper, imageSetMapper)
-		messageConsumer := consumer.NewConsumer(consumerConfig, a.queue.onMessage, &httpClient)
-		a.queue.messageConsumer = messageConsumer
+	}
+	cliApp.Action = func() {
+		a.validateQueueArgs()
+		logEvent(serviceEvent, "").WithFields(logrus.Fields{
+			"system_code":   a.args.appSystemCode,
+			"app_name":      a.args.appName,
+			"port":          a.args.port,
+			"queue_backend": a.args.queueBackend,
+		}).Info("methode-article-image-set-mapper is starting.")
+		clients := a.newQueueClients()
+		defer clients.close()
+		a.setup(clients.newConsumer, clients.messageProducer, clients.relationsProducer)
 		a.queue.startConsuming()
-		httpMappingHandler := newHTTPMappingHandler(messageToNativeMapper, imageSetMapper)
-		healthService := NewHealthCheck(messageProducer, messageConsumer, a.args.appSystemCode, a.args.appName)
-		routing := newRouting(httpMappingHandler, healthService)
-		go routing.listenAndServe(a.args.port)
+		go a.routing.listenAndServe(a.args.port)
 		a.waitForSignals()
-		a.queue.stop()
+		err := a.shutdown(time.Duration(a.args.shutdownTimeoutSeconds)*time.Second, time.Duration(a.args.shutdownDrainDelaySeconds)*time.Second)
+		if err != nil {
+			logEvent(serviceEvent, "").WithError(err).Error("methode-article-image-set-mapper didn't shut down cleanly.")
+		}
 	}
+	cliApp.Command("replay", "Maps native articles read from files and prints or sends their image-sets.", a.replayCommand)
+	cliApp.Command("image-set-origin", "Prints the article and Methode element image-sets were mapped from.", a.originCommand)
+	cliApp.Command("diff", "Prints what changed in the image-sets between two versions of an article.", a.diffCommand)
 	err := cliApp.Run(os.Args)
 	if err != nil {
-		logrus.Fatalf("methode-article-image-set-mapper could not start. %v\n", err)
+		logEvent(serviceEvent, "").WithError(err).Fatal("methode-article-image-set-mapper could not start.")
 	}
 }
 
@@ -81,6 +70,7 @@ type args struct {
 	appSystemCode string
 	appName       string
 	port          string
+	logLevel      string
 
 	addresses     []string
 	group         string
@@ -89,9 +79,50 @@ type args struct {
 	writeTopic    string
 	writeQueue    string
 	authorization string
+
+	relationsTopic string
+
+	atomicPublish          bool
+	publishRetries         int
+	publishRetryIntervalMs int
+
+	publishRate  int
+	publishBurst int
+
+	shutdownTimeoutSeconds    int
+	shutdownDrainDelaySeconds int
+
+	originSystemIDs      []string
+	outputOriginSystemID string
+
+	invalidTimestampPolicy string
+
+	queueBackend   string
+	kafkaAddresses []string
+
+	outputMessageType  string
+	outputContentType  string
+	contentURIBase     string
+	extraHeaders       []string
+	passThroughHeaders []string
+
+	orderStoreSize int
+	orderStorePath string
+
+	batchMaxBytes    int
+	batchConcurrency int
+
+	imageSetStorePath string
+
+	publishAPIKey string
+
+	dryRun           bool
+	dryRunBufferSize int
 }
 
-func resolveArgs(app *cli.Cli) args {
+// resolveArgs declares the options of the service, and returns what reads their values. Options are only parsed when
+// the app runs, so it's meant to be called from an action, the one of a command included.
+func resolveArgs(app *cli.Cli) func() args {
 	appSystemCode := app.String(cli.StringOpt{
 		Name:   "app-system-code",
 		Value:  "methode-article-image-set-mapper",
@@ -110,6 +141,12 @@ func resolveArgs(app *cli.Cli) args {
 		Desc:   "Port to listen on",
 		EnvVar: "APP_PORT",
 	})
+	logLevel := app.String(cli.StringOpt{
+		Name:   "log-level",
+		Value:  "info",
+		Desc:   "Level of the logs: debug, info, warning, error, fatal or panic. It can be changed while running on " + logLevelPath + ".",
+		EnvVar: "LOG_LEVEL",
+	})
 
 	addresses := app.Strings(cli.StringsOpt{
 		Name:   "queue-addresses",
@@ -152,26 +189,501 @@ func resolveArgs(app *cli.Cli) args {
 		Desc:   "Authorization key to access the queue.",
 		EnvVar: "Q_AUTHORIZATION",
 	})
-	return args{
-		appSystemCode: *appSystemCode,
-		appName:       *appName,
-		port:          *port,
-		addresses:     *addresses,
-		group:         *group,
-		readTopic:     *readTopic,
-		readQueue:     *readQueue,
-		writeTopic:    *writeTopic,
-		writeQueue:    *writeQueue,
-		authorization: *authorization,
+
+	relationsTopic := app.String(cli.StringOpt{
+		Name:   "relations-topic",
+		Desc:   "The topic to write the article to image-sets relations to. No relations are written when empty.",
+		EnvVar: "Q_RELATIONS_TOPIC",
+	})
+
+	atomicPublish := app.Bool(cli.BoolOpt{
+		Name:   "atomic-publish",
+		Value:  false,
+		Desc:   "Publish the image-sets of an article all-or-nothing: nothing is sent if any message can't be built, and failed sends are retried.",
+		EnvVar: "ATOMIC_PUBLISH",
+	})
+
+	publishRetries := app.Int(cli.IntOpt{
+		Name:   "publish-retries",
+		Value:  3,
+		Desc:   "How many times a failed send is retried when atomic-publish is enabled.",
+		EnvVar: "PUBLISH_RETRIES",
+	})
+
+	publishRetryIntervalMs := app.Int(cli.IntOpt{
+		Name:   "publish-retry-interval-ms",
+		Value:  500,
+		Desc:   "Milliseconds to wait between retries of a failed send when atomic-publish is enabled.",
+		EnvVar: "PUBLISH_RETRY_INTERVAL_MS",
+	})
+
+	publishRate := app.Int(cli.IntOpt{
+		Name:   "publish-rate",
+		Value:  0,
+		Desc:   "Most messages to publish per second, 0 for no limit.",
+		EnvVar: "PUBLISH_RATE",
+	})
+
+	publishBurst := app.Int(cli.IntOpt{
+		Name:   "publish-burst",
+		Value:  10,
+		Desc:   "Most messages to publish at once when publish-rate allows it.",
+		EnvVar: "PUBLISH_BURST",
+	})
+
+	shutdownTimeoutSeconds := app.Int(cli.IntOpt{
+		Name:   "shutdown-timeout",
+		Value:  20,
+		Desc:   "Seconds to wait for in-flight articles and HTTP requests to finish on shutdown.",
+		EnvVar: "SHUTDOWN_TIMEOUT",
+	})
+
+	shutdownDrainDelaySeconds := app.Int(cli.IntOpt{
+		Name:   "shutdown-drain-delay",
+		Value:  5,
+		Desc:   "Seconds to keep serving HTTP requests on shutdown after /__gtg starts failing, for load balancers to stop sending requests.",
+		EnvVar: "SHUTDOWN_DRAIN_DELAY",
+	})
+
+	originSystemIDs := app.Strings(cli.StringsOpt{
+		Name:   "origin-system-ids",
+		Value:  []string{methodeSystemOrigin},
+		Desc:   "Origin-System-Id values of the messages that are mapped. Messages from any other origin are ignored.",
+		EnvVar: "ORIGIN_SYSTEM_IDS",
+	})
+
+	outputOriginSystemID := app.String(cli.StringOpt{
+		Name:   "output-origin-system-id",
+		Value:  methodeSystemOrigin,
+		Desc:   "Origin-System-Id set on the published image-sets. When empty, the one of the incoming message is passed through.",
+		EnvVar: "OUTPUT_ORIGIN_SYSTEM_ID",
+	})
+
+	invalidTimestampPolicy := app.String(cli.StringOpt{
+		Name:   "invalid-timestamp-policy",
+		Value:  replaceInvalidTimestamps,
+		Desc:   "What to do with messages whose Message-Timestamp can't be parsed: replace it with the current time, or reject the message.",
+		EnvVar: "INVALID_TIMESTAMP_POLICY",
+	})
+
+	queueBackend := app.String(cli.StringOpt{
+		Name:   "queue-backend",
+		Value:  proxyQueueBackend,
+		Desc:   "How to read from and write to the queue: proxy, through the kafka REST proxy, or kafka, straight to the brokers.",
+		EnvVar: "QUEUE_BACKEND",
+	})
+
+	kafkaAddresses := app.Strings(cli.StringsOpt{
+		Name:   "kafka-addresses",
+		Desc:   "Addresses of the kafka brokers (host:port), used when queue-backend is kafka.",
+		EnvVar: "KAFKA_ADDRESSES",
+	})
+
+	outputMessageType := app.String(cli.StringOpt{
+		Name:   "output-message-type",
+		Value:  defaultMessageType,
+		Desc:   "Message-Type header of the published image-sets.",
+		EnvVar: "OUTPUT_MESSAGE_TYPE",
+	})
+
+	outputContentType := app.String(cli.StringOpt{
+		Name:   "output-content-type",
+		Value:  defaultContentType,
+		Desc:   "Content-Type header of the published image-sets.",
+		EnvVar: "OUTPUT_CONTENT_TYPE",
+	})
+
+	contentURIBase := app.String(cli.StringOpt{
+		Name:   "content-uri-base",
+		Value:  defaultContentURIBase,
+		Desc:   "Base of the contentUri of the published image-sets, the image-set uuid is appended to it.",
+		EnvVar: "CONTENT_URI_BASE",
+	})
+
+	extraHeaders := app.Strings(cli.StringsOpt{
+		Name:   "extra-headers",
+		Desc:   "Static headers added to the published image-sets, as Name:Value.",
+		EnvVar: "EXTRA_HEADERS",
+	})
+
+	passThroughHeaders := app.Strings(cli.StringsOpt{
+		Name:   "pass-through-headers",
+		Desc:   "Headers copied from the consumed article message to its published image-sets, when present.",
+		EnvVar: "PASS_THROUGH_HEADERS",
+	})
+
+	orderStoreSize := app.Int(cli.IntOpt{
+		Name:   "order-store-size",
+		Value:  100000,
+		Desc:   "How many articles to remember the latest published version of, to skip older versions consumed later. 0 disables the check.",
+		EnvVar: "ORDER_STORE_SIZE",
+	})
+
+	orderStorePath := app.String(cli.StringOpt{
+		Name:   "order-store-path",
+		Desc:   "File to keep the latest published article versions in across restarts. When empty, they're only kept in memory.",
+		EnvVar: "ORDER_STORE_PATH",
+	})
+
+	batchMaxBytes := app.Int(cli.IntOpt{
+		Name:   "batch-max-bytes",
+		Value:  32 * 1024 * 1024,
+		Desc:   "Largest request body accepted by /map/batch, in bytes.",
+		EnvVar: "BATCH_MAX_BYTES",
+	})
+
+	batchConcurrency := app.Int(cli.IntOpt{
+		Name:   "batch-concurrency",
+		Value:  4,
+		Desc:   "Most articles of one /map/batch request mapped at once.",
+		EnvVar: "BATCH_CONCURRENCY",
+	})
+
+	imageSetStorePath := app.String(cli.StringOpt{
+		Name:   "image-set-store-path",
+		Desc:   "File to keep the last published image-sets in, served by the lookup endpoints. When empty, nothing is kept and the lookup endpoints aren't served.",
+		EnvVar: "IMAGE_SET_STORE_PATH",
+	})
+
+	publishAPIKey := app.String(cli.StringOpt{
+		Name:   "publish-api-key",
+		Desc:   "Key to give as the Authorization header of /publish requests. When empty, /publish isn't served.",
+		EnvVar: "PUBLISH_API_KEY",
+	})
+
+	dryRun := app.Bool(cli.BoolOpt{
+		Name:   "dry-run",
+		Value:  false,
+		Desc:   "Consume and map articles without sending anything, keeping the messages that would have been sent for " + dryRunPath + ".",
+		EnvVar: "DRY_RUN",
+	})
+
+	dryRunBufferSize := app.Int(cli.IntOpt{
+		Name:   "dry-run-buffer-size",
+		Value:  100,
+		Desc:   "How many of the last messages to keep with dry-run.",
+		EnvVar: "DRY_RUN_BUFFER_SIZE",
+	})
+	return func() args {
+		return args{
+			appSystemCode: *appSystemCode,
+			appName:       *appName,
+			port:          *port,
+			logLevel:      *logLevel,
+			addresses:     *addresses,
+			group:         *group,
+			readTopic:     *readTopic,
+			readQueue:     *readQueue,
+			writeTopic:    *writeTopic,
+			writeQueue:    *writeQueue,
+			authorization: *authorization,
+
+			relationsTopic: *relationsTopic,
+
+			atomicPublish:          *atomicPublish,
+			publishRetries:         *publishRetries,
+			publishRetryIntervalMs: *publishRetryIntervalMs,
+
+			publishRate:  *publishRate,
+			publishBurst: *publishBurst,
+
+			shutdownTimeoutSeconds:    *shutdownTimeoutSeconds,
+			shutdownDrainDelaySeconds: *shutdownDrainDelaySeconds,
+
+			originSystemIDs:      *originSystemIDs,
+			outputOriginSystemID: *outputOriginSystemID,
+
+			invalidTimestampPolicy: *invalidTimestampPolicy,
+
+			queueBackend:   *queueBackend,
+			kafkaAddresses: *kafkaAddresses,
+
+			outputMessageType:  *outputMessageType,
+			outputContentType:  *outputContentType,
+			contentURIBase:     *contentURIBase,
+			extraHeaders:       *extraHeaders,
+			passThroughHeaders: *passThroughHeaders,
+
+			orderStoreSize: *orderStoreSize,
+			orderStorePath: *orderStorePath,
+
+			batchMaxBytes:    *batchMaxBytes,
+			batchConcurrency: *batchConcurrency,
+
+			imageSetStorePath: *imageSetStorePath,
+
+			publishAPIKey: *publishAPIKey,
+
+			dryRun:           *dryRun,
+			dryRunBufferSize: *dryRunBufferSize,
+		}
+	}
+}
+
+func (a *app) validateQueueArgs() {
+	if a.args.queueBackend != proxyQueueBackend && a.args.queueBackend != kafkaQueueBackend {
+		logEvent(serviceEvent, "").WithField("queue_backend", a.args.queueBackend).Fatalf("Unknown queue backend, should be one of %v or %v. Quitting...", proxyQueueBackend, kafkaQueueBackend)
+	}
+	if a.args.queueBackend == proxyQueueBackend && len(a.args.addresses) == 0 {
+		logEvent(serviceEvent, "").Fatal("No queue address provided. Quitting...")
+	}
+	if a.args.queueBackend == kafkaQueueBackend && len(a.args.kafkaAddresses) == 0 {
+		logEvent(serviceEvent, "").Fatal("No kafka address provided. Quitting...")
+	}
+	if a.args.invalidTimestampPolicy != replaceInvalidTimestamps && a.args.invalidTimestampPolicy != rejectInvalidTimestamps {
+		logEvent(serviceEvent, "").WithField("invalid_timestamp_policy", a.args.invalidTimestampPolicy).Fatalf("Unknown invalid timestamp policy, should be one of %v or %v. Quitting...", replaceInvalidTimestamps, rejectInvalidTimestamps)
+	}
+}
+
+// queueClients are the consumer and producers of the chosen queue backend. The relations producer is nil when no
+// relations topic is configured.
+type queueClients struct {
+	newConsumer       func(handler func(m consumer.Message) error) consumer.MessageConsumer
+	messageProducer   producer.MessageProducer
+	relationsProducer producer.MessageProducer
+	closers           []func() error
+}
+
+func (c queueClients) close() {
+	for _, closer := range c.closers {
+		err := closer()
+		if err != nil {
+			logEvent(queueEvent, "").WithError(err).Warn("Couldn't close queue client.")
+		}
+	}
+}
+
+func (a *app) newQueueClients() queueClients {
+	if a.args.queueBackend == kafkaQueueBackend {
+		return a.newKafkaClients()
+	}
+	return a.newProxyClients()
+}
+
+func (a *app) newKafkaClients() queueClients {
+	kafkaConfig := newKafkaConfig(a.args.appSystemCode)
+	logEvent(queueEvent, "").WithFields(logrus.Fields{
+		"brokers":     a.args.kafkaAddresses,
+		"group":       a.args.group,
+		"read_topic":  a.args.readTopic,
+		"write_topic": a.args.writeTopic,
+	}).Info("Connecting to kafka.")
+	messageProducer := newKafkaProducer(a.args.kafkaAddresses, a.args.writeTopic, kafkaConfig)
+	clients := queueClients{
+		newConsumer: func(handler func(m consumer.Message) error) consumer.MessageConsumer {
+			return newKafkaConsumer(a.args.kafkaAddresses, a.args.group, a.args.readTopic, kafkaConfig, handler)
+		},
+		messageProducer: messageProducer,
+		closers:         []func() error{messageProducer.Close},
+	}
+	if a.args.relationsTopic != "" {
+		relationsProducer := newKafkaProducer(a.args.kafkaAddresses, a.args.relationsTopic, kafkaConfig)
+		clients.relationsProducer = relationsProducer
+		clients.closers = append(clients.closers, relationsProducer.Close)
+	}
+	return clients
+}
+
+func (a *app) newProxyClients() queueClients {
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConnsPerHost:   20,
+			TLSHandshakeTimeout:   3 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+	consumerConfig := consumer.QueueConfig{
+		Addrs:                a.args.addresses,
+		Group:                a.args.group,
+		Topic:                a.args.readTopic,
+		Queue:                a.args.readQueue,
+		ConcurrentProcessing: false,
+		AutoCommitEnable:     false,
+		AuthorizationKey:     a.args.authorization,
+	}
+	producerConfig := producer.MessageProducerConfig{
+		Addr:          a.args.addresses[0],
+		Topic:         a.args.writeTopic,
+		Queue:         a.args.writeQueue,
+		Authorization: a.args.authorization,
+	}
+	prettyPrintConfig(consumerConfig, producerConfig)
+	clients := queueClients{
+		newConsumer: func(handler func(m consumer.Message) error) consumer.MessageConsumer {
+			return newProxyConsumer(consumerConfig, handler, httpClient)
+		},
+		messageProducer: producer.NewMessageProducerWithHTTPClient(producerConfig, httpClient),
+	}
+	if a.args.relationsTopic != "" {
+		relationsProducerConfig := producerConfig
+		relationsProducerConfig.Topic = a.args.relationsTopic
+		clients.relationsProducer = producer.NewMessageProducerWithHTTPClient(relationsProducerConfig, httpClient)
+	}
+	return clients
+}
+
+// setup wires the mappers, the queue and the HTTP routes. newConsumer creates the consumer of the chosen queue backend,
+// feeding messages to the given handler.
+func (a *app) setup(newConsumer func(handler func(m consumer.Message) error) consumer.MessageConsumer, messageProducer producer.MessageProducer, relationsProducer producer.MessageProducer) {
+	messageToNativeMapper := defaultMessageToNativeMapper{}
+	imageSetMapper := newImageSetMapper(defaultArticleToImageSetMapper{}, defaultAttributesMapper{}, defaultImageSetToJSONMapper{})
+	limiter := newSendLimiter(a.args.publishRate, a.args.publishBurst)
+	queueProducer, queueRelationsProducer := messageProducer, relationsProducer
+	var dryRunMessages *dryRunMessages
+	if a.args.dryRun {
+		logEvent(serviceEvent, "").WithFields(logrus.Fields{"buffer_size": a.args.dryRunBufferSize, "path": dryRunPath}).Warn("Dry-run, no message will be sent. The last ones are served on the dry-run endpoint.")
+		dryRunMessages = newDryRunMessages(a.args.dryRunBufferSize)
+		queueProducer = newDryRunProducer(messageProducer, "image-sets", dryRunMessages)
+		queueRelationsProducer = newDryRunProducer(relationsProducer, "relations", dryRunMessages)
+	}
+	throttled := sendThrottledSeconds.WithLabelValues(serviceLimiter)
+	a.queue = a.newConfiguredQueue(newRateLimitedProducer(queueProducer, limiter, throttled),
+		newRateLimitedProducer(queueRelationsProducer, limiter, throttled), messageToNativeMapper, imageSetMapper)
+	a.queue.articleVersions = a.newArticleVersions()
+	a.queue.imageSetStore = a.newImageSetStore()
+	a.queue.dryRun = a.args.dryRun
+	messageConsumer := newConsumer(a.queue.onMessage)
+	a.queue.messageConsumer = messageConsumer
+	httpMappingHandler := newHTTPMappingHandler(messageToNativeMapper, imageSetMapper, a.queue)
+	a.healthCheck = NewHealthCheck(messageProducer, messageConsumer, a.args.appSystemCode, a.args.appName)
+	batchMappingHandler := newBatchMappingHandler(messageToNativeMapper, imageSetMapper, int64(a.args.batchMaxBytes), a.args.batchConcurrency)
+	validationHandler := newValidationHandler(messageToNativeMapper, imageSetMapper)
+	diffHandler := newDiffHandler(messageToNativeMapper, imageSetMapper)
+	var lookupHandler *imageSetLookupHandler
+	if a.queue.imageSetStore != nil {
+		lookupHandler = newImageSetLookupHandler(a.queue.imageSetStore)
+	}
+	var publishHandler *publishHandler
+	if a.args.publishAPIKey != "" {
+		publishHandler = newPublishHandler(messageToNativeMapper, a.queue, a.args.publishAPIKey)
+	}
+	a.routing = newRouting(httpMappingHandler, batchMappingHandler, validationHandler, diffHandler, lookupHandler, publishHandler, dryRunMessages, a.healthCheck)
+}
+
+// newConfiguredQueue returns a queue that maps and publishes articles the way the options ask for. It has no consumer.
+func (a *app) newConfiguredQueue(messageProducer producer.MessageProducer, relationsProducer producer.MessageProducer,
+	messageToNativeMapper MessageToNativeMapper, imageSetMapper ImageSetMapper) *defaultQueue {
+	q := newQueue(nil, messageProducer, messageToNativeMapper, imageSetMapper)
+	q.relationsProducer = relationsProducer
+	q.atomicPublish = a.args.atomicPublish
+	q.publishRetries = a.args.publishRetries
+	q.publishRetryInterval = time.Duration(a.args.publishRetryIntervalMs) * time.Millisecond
+	if len(a.args.originSystemIDs) != 0 {
+		q.acceptedOrigins = a.args.originSystemIDs
+	}
+	q.outgoingOrigin = a.args.outputOriginSystemID
+	if a.args.invalidTimestampPolicy == rejectInvalidTimestamps {
+		q.invalidTimestampPolicy = rejectInvalidTimestamps
+	}
+	if a.args.outputMessageType != "" {
+		q.messageType = a.args.outputMessageType
+	}
+	if a.args.outputContentType != "" {
+		q.contentType = a.args.outputContentType
+	}
+	if a.args.contentURIBase != "" {
+		q.contentURIBase = withTrailingSlash(a.args.contentURIBase)
 	}
+	q.extraHeaders = parseHeaders(a.args.extraHeaders)
+	q.passThroughHeaders = a.args.passThroughHeaders
+	return q
 }
 
-func (m app) waitForSignals() {
+// newArticleVersions returns the store of the latest published article versions, or nil when the check is disabled.
+func (a *app) newArticleVersions() *articleVersions {
+	if a.args.orderStoreSize <= 0 {
+		return nil
+	}
+	if a.args.orderStorePath == "" {
+		return newArticleVersions(a.args.orderStoreSize)
+	}
+	versions, err := openArticleVersions(a.args.orderStoreSize, a.args.orderStorePath)
+	if err != nil {
+		logEvent(storeEvent, "").WithError(err).Fatal("Couldn't open article versions store. Quitting...")
+	}
+	return versions
+}
+
+// newImageSetStore returns the store of the published image-sets, or nil when none is configured.
+func (a *app) newImageSetStore() *imageSetStore {
+	if a.args.imageSetStorePath == "" {
+		return nil
+	}
+	store, err := openImageSetStore(a.args.imageSetStorePath)
+	if err != nil {
+		logEvent(storeEvent, "").WithError(err).Fatal("Couldn't open image-set store. Quitting...")
+	}
+	return store
+}
+
+// parseHeaders reads headers given as Name:Value, skipping the ones without a name.
+func parseHeaders(values []string) map[string]string {
+	headers := make(map[string]string)
+	for _, value := range values {
+		nameValue := strings.SplitN(value, ":", 2)
+		name := strings.TrimSpace(nameValue[0])
+		if len(nameValue) != 2 || name == "" {
+			logEvent(serviceEvent, "").WithField("header", value).Warn("Ignoring extra header that isn't given as Name:Value.")
+			continue
+		}
+		headers[name] = strings.TrimSpace(nameValue[1])
+	}
+	return headers
+}
+
+func withTrailingSlash(uri string) string {
+	if strings.HasSuffix(uri, "/") {
+		return uri
+	}
+	return uri + "/"
+}
+
+func (a *app) waitForSignals() {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
 }
 
+// shutdown reports not good-to-go, stops consuming and waits for the in-flight article, while the HTTP server keeps
+// serving for at least drainDelay so that load balancers see the failing check before connections are refused. Then it
+// waits for the open HTTP requests, before closing the stores. All of it has to fit in the timeout after the delay.
+func (a *app) shutdown(timeout time.Duration, drainDelay time.Duration) error {
+	logEvent(serviceEvent, "").WithFields(logrus.Fields{"timeout": timeout.String(), "drain_delay": drainDelay.String()}).Info("methode-article-image-set-mapper is shutting down.")
+	ctx, cancel := context.WithTimeout(context.Background(), drainDelay+timeout)
+	defer cancel()
+	a.healthCheck.markShuttingDown()
+	drained := time.After(drainDelay)
+	queueErr := a.queue.stop(ctx)
+	if queueErr != nil {
+		logEvent(serviceEvent, "").WithError(queueErr).Error("Couldn't drain in-flight articles.")
+	}
+	<-drained
+	err := a.routing.shutdown(ctx)
+	a.closeStores()
+	if err != nil {
+		return fmt.Errorf("Couldn't shut down HTTP server. %v", err)
+	}
+	return queueErr
+}
+
+func (a *app) closeStores() {
+	if a.queue.articleVersions != nil {
+		if err := a.queue.articleVersions.close(); err != nil {
+			logEvent(storeEvent, "").WithError(err).Warn("Couldn't close article versions store.")
+		}
+	}
+	if a.queue.imageSetStore != nil {
+		if err := a.queue.imageSetStore.close(); err != nil {
+			logEvent(storeEvent, "").WithError(err).Warn("Couldn't close image-set store.")
+		}
+	}
+}
+
 func prettyPrintConfig(consumerConfig consumer.QueueConfig, producerConfig producer.MessageProducerConfig) string {
 	return fmt.Sprintf("Config: [\n\t%s\n\t%s\n]", prettyPrintConsumerConfig(consumerConfig), prettyPrintProducerConfig(producerConfig))
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/message-queue-go-producer/producer"
+	"github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/jawher/mow.cli"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingProducer holds every send until it's released, to keep an article in-flight while shutting down.
+type blockingProducer struct {
+	sync.Mutex
+	sending chan struct{}
+	release chan struct{}
+	sent    int
+}
+
+func newBlockingProducer() *blockingProducer {
+	return &blockingProducer{sending: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (p *blockingProducer) SendMessage(key string, msg producer.Message) error {
+	p.sending <- struct{}{}
+	<-p.release
+	p.Lock()
+	defer p.Unlock()
+	p.sent++
+	return nil
+}
+
+func (p *blockingProducer) ConnectivityCheck() (string, error) {
+	return "", nil
+}
+
+func (p *blockingProducer) sentCount() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.sent
+}
+
+func startTestApp(t *testing.T, proxyURL string, messageProducer producer.MessageProducer) (*app, string) {
+	a := &app{args: args{appSystemCode: "methode-article-image-set-mapper", appName: "methode-article-image-set-mapper"}}
+	a.setup(func(handler func(m consumer.Message) error) consumer.MessageConsumer {
+		c := newProxyConsumer(consumer.QueueConfig{
+			Addrs: []string{proxyURL},
+			Group: "methode-article-image-set-mapper",
+			Topic: "NativeCmsPublicationEvents",
+		}, handler, http.DefaultClient)
+		c.backoff = 10 * time.Millisecond
+		return c
+	}, messageProducer, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go a.routing.serve(listener)
+	a.queue.startConsuming()
+	return a, "http://" + listener.Addr().String()
+}
+
+// gtgClient doesn't keep connections open, as a spare one that never got a request would hold the HTTP server shutdown.
+var gtgClient = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+func gtgStatus(url string) int {
+	resp, err := gtgClient.Get(url + "/__gtg")
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestApp_GracefulShutdown(t *testing.T) {
+	article, err := ioutil.ReadFile("sample-methode-native-article-c17e8abe-1df8-11e7-942c-4a4c42b3072e.json")
+	assert.NoError(t, err)
+	proxy := newFakeQueueProxy(string(article))
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	messageProducer := newBlockingProducer()
+
+	a, url := startTestApp(t, proxyServer.URL, messageProducer)
+	assert.Equal(t, http.StatusOK, gtgStatus(url), "Should be good to go before shutdown")
+
+	select {
+	case <-messageProducer.sending:
+	case <-time.After(2 * time.Second):
+		assert.FailNow(t, "The article was never sent")
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- a.shutdown(5*time.Second, 0)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for gtgStatus(url) != http.StatusServiceUnavailable && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, gtgStatus(url), "Should not be good to go while shutting down")
+
+	select {
+	case <-done:
+		assert.FailNow(t, "Shutdown shouldn't finish before the in-flight article is published")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, 0, proxy.committedOffset())
+
+	close(messageProducer.release)
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "Shutdown didn't finish after the in-flight article was published")
+	}
+
+	assert.Equal(t, 2, messageProducer.sentCount(), "Both image-sets of the in-flight article should be sent")
+	assert.Equal(t, 1, proxy.committedOffset(), "The in-flight article should be committed before stopping")
+	assert.Equal(t, 0, gtgStatus(url), "HTTP server should be closed after shutdown")
+}
+
+func TestApp_ShutdownGivesUpAfterTimeout(t *testing.T) {
+	article, err := ioutil.ReadFile("sample-methode-native-article-c17e8abe-1df8-11e7-942c-4a4c42b3072e.json")
+	assert.NoError(t, err)
+	proxy := newFakeQueueProxy(string(article))
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	messageProducer := newBlockingProducer()
+	defer close(messageProducer.release)
+
+	a, url := startTestApp(t, proxyServer.URL, messageProducer)
+	<-messageProducer.sending
+
+	err = a.shutdown(100*time.Millisecond, 0)
+	assert.Error(t, err, "Shutdown should report the article it couldn't wait for")
+	assert.Equal(t, 0, proxy.committedOffset())
+	assert.Equal(t, 0, gtgStatus(url), "HTTP server should be closed even when the queue couldn't be drained")
+}
+
+func TestApp_ShutdownKeepsServingDuringDrainDelay(t *testing.T) {
+	article, err := ioutil.ReadFile("sample-methode-native-article-c17e8abe-1df8-11e7-942c-4a4c42b3072e.json")
+	assert.NoError(t, err)
+	proxy := newFakeQueueProxy(string(article))
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	messageProducer := newBlockingProducer()
+	close(messageProducer.release)
+
+	a, url := startTestApp(t, proxyServer.URL, messageProducer)
+	<-messageProducer.sending
+
+	done := make(chan error)
+	go func() {
+		done <- a.shutdown(5*time.Second, 300*time.Millisecond)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, gtgStatus(url), "Should keep answering that it's not good to go during the drain delay")
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "Shutdown didn't finish after the drain delay")
+	}
+	assert.Equal(t, 0, gtgStatus(url), "HTTP server should be closed after shutdown")
+}
+
+func TestResolveArgs_ReadsParsedOptionsInCommands(t *testing.T) {
+	cliApp := cli.App("methode-article-image-set-mapper", "")
+	parsedArgs := resolveArgs(cliApp)
+	var resolved args
+	cliApp.Command("replay", "", func(cmd *cli.Cmd) {
+		cmd.Action = func() {
+			resolved = parsedArgs()
+		}
+	})
+
+	assert.NoError(t, cliApp.Run([]string{"methode-article-image-set-mapper", "--write-topic=ReplayedImageSets", "--atomic-publish=true", "replay"}))
+
+	assert.Equal(t, "ReplayedImageSets", resolved.writeTopic)
+	assert.True(t, resolved.atomicPublish)
+}
+
+func TestParseHeaders(t *testing.T) {
+	headers := parseHeaders([]string{"X-Environment: staging", "X-Empty:", "no-separator", ":no-name", "X-Url:http://example.com"})
+	assert.Equal(t, map[string]string{"X-Environment": "staging", "X-Empty": "", "X-Url": "http://example.com"}, headers)
+}
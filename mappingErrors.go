@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Codes of the errors answered by the endpoints and of the /validate diagnostics. They're documented in
+// api/openapi.yml and clients can rely on them, so they're never renamed.
+const (
+	invalidRequestCode    = "INVALID_REQUEST"
+	invalidNativeJSONCode = "NATIVE_JSON_INVALID"
+	partMissingCode       = "PART_MISSING"
+	batchTooLargeCode     = "BATCH_TOO_LARGE"
+	invalidUUIDCode       = "INVALID_UUID"
+	badBase64Code         = "BAD_BASE64"
+	bodyXMLInvalidCode    = "BODY_XML_INVALID"
+	attributesInvalidCode = "ATTRIBUTES_INVALID"
+	dateMissingCode       = "DATE_MISSING"
+	dateInvalidCode       = "DATE_INVALID"
+	mappingFailedCode     = "MAPPING_FAILED"
+	memberMissingCode     = "MEMBER_MISSING"
+	memberWithoutUUIDCode = "MEMBER_WITHOUT_UUID"
+	notFoundCode          = "NOT_FOUND"
+	unauthorizedCode      = "UNAUTHORIZED"
+	publishFailedCode     = "PUBLISH_FAILED"
+	internalErrorCode     = "INTERNAL_ERROR"
+)
+
+// Stages of the mapping an error comes from.
+const (
+	requestStage    = "request"
+	nativeStage     = "native"
+	uuidStage       = "uuid"
+	bodyStage       = "body"
+	attributesStage = "attributes"
+	imageSetStage   = "image-set"
+	storeStage      = "store"
+	publishStage    = "publish"
+	responseStage   = "response"
+)
+
+// mappingError is an error with a stable code, telling at which stage and on which field the mapping failed.
+type mappingError struct {
+	code       string
+	stage      string
+	field      string
+	imageSetID string
+	err        error
+}
+
+func newMappingError(code string, stage string, field string, err error) *mappingError {
+	return &mappingError{code: code, stage: stage, field: field, err: err}
+}
+
+func (e *mappingError) Error() string {
+	return e.err.Error()
+}
+
+func newInternalError(stage string, err error) *mappingError {
+	return newMappingError(internalErrorCode, stage, "", err)
+}
+
+// prefixed returns the same error with the message preceded by msg.
+func (e *mappingError) prefixed(msg string) *mappingError {
+	prefixed := *e
+	prefixed.err = fmt.Errorf("%v %v", msg, e.err)
+	return &prefixed
+}
+
+// status is the HTTP status of the class of the error: 400 for requests that can't be read, 413 for batches that are
+// too large, 401 for requests without a valid key, 404 for what isn't stored, 500 for failures of the service, 502 for
+// publications the queue didn't take and 422 for articles that can't be mapped.
+func (e *mappingError) status() int {
+	switch e.code {
+	case invalidRequestCode, invalidNativeJSONCode, partMissingCode:
+		return http.StatusBadRequest
+	case batchTooLargeCode:
+		return http.StatusRequestEntityTooLarge
+	case unauthorizedCode:
+		return http.StatusUnauthorized
+	case notFoundCode:
+		return http.StatusNotFound
+	case publishFailedCode:
+		return http.StatusBadGateway
+	case internalErrorCode:
+		return http.StatusInternalServerError
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// asMappingError returns err when it's a mappingError, otherwise err with the given code and stage.
+func asMappingError(err error, code string, stage string) *mappingError {
+	if mappingErr, ok := err.(*mappingError); ok {
+		return mappingErr
+	}
+	return newMappingError(code, stage, "", err)
+}
@@ -50,9 +50,9 @@ type mockedXmlImageSetToJSONMapper struct {
 	mock.Mock
 }
 
-func (m *mockedXmlImageSetToJSONMapper) Map(xmlImageSets []XMLImageSet, articleUuid string, attributes xmlAttributes, lastModified string, publishReference string) ([]JSONImageSet, error) {
+func (m *mockedXmlImageSetToJSONMapper) Map(xmlImageSets []XMLImageSet, articleUuid string, attributes xmlAttributes, lastModified string, publishReference string) ([]JSONImageSet, []MappingDiagnostic, error) {
 	args := m.Called(xmlImageSets)
-	return args.Get(0).([]JSONImageSet), args.Error(1)
+	return args.Get(0).([]JSONImageSet), nil, args.Error(1)
 }
 
 type mockAttributesMapper struct {
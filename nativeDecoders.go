@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	multipartMediaType = "multipart/form-data"
+	uuidPart           = "uuid"
+	bodyPart           = "body"
+	attributesPart     = "attributes"
+)
+
+// xmlBundle is a native article given as XML, without the JSON envelope. The body and the attributes are either
+// written inside their elements as they are, without the XML declaration, or escaped or in a CDATA section.
+type xmlBundle struct {
+	XMLName    xml.Name      `xml:"native-article"`
+	UUID       string        `xml:"uuid,attr"`
+	Body       xmlBundlePart `xml:"body"`
+	Attributes xmlBundlePart `xml:"attributes"`
+}
+
+type xmlBundlePart struct {
+	Text  string `xml:",chardata"`
+	Inner string `xml:",innerxml"`
+}
+
+func (p xmlBundlePart) content() string {
+	inner := strings.TrimSpace(p.Inner)
+	if strings.HasPrefix(inner, "<") && !strings.HasPrefix(inner, "<![CDATA[") {
+		return inner
+	}
+	return strings.TrimSpace(p.Text)
+}
+
+// isXMLBundle reports whether the Content-Type is one of an XML bundle rather than of the native JSON.
+func isXMLBundle(mediaType string) bool {
+	return mediaType == "application/xml" || mediaType == "text/xml"
+}
+
+func requestMediaType(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+func nativeFromXMLBundle(source []byte) (NativeContent, error) {
+	var bundle xmlBundle
+	err := xml.Unmarshal(source, &bundle)
+	if err != nil {
+		return NativeContent{}, fmt.Errorf("Couldn't decode XML bundle. %v", err)
+	}
+	return newNativeContent(bundle.UUID, bundle.Body.content(), bundle.Attributes.content())
+}
+
+// nativeFromMultipart reads the uuid, body and attributes parts of a multipart/form-data request. They can be given as
+// fields or as files.
+func nativeFromMultipart(r *http.Request) (NativeContent, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return NativeContent{}, fmt.Errorf("Couldn't read multipart body. %v", err)
+	}
+	parts := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return NativeContent{}, fmt.Errorf("Couldn't read multipart body. %v", err)
+		}
+		value, err := ioutil.ReadAll(part)
+		if err != nil {
+			return NativeContent{}, fmt.Errorf("Couldn't read part %v. %v", part.FormName(), err)
+		}
+		parts[part.FormName()] = strings.TrimSpace(string(value))
+	}
+	return newNativeContent(parts[uuidPart], parts[bodyPart], parts[attributesPart])
+}
+
+func newNativeContent(uuid string, body string, attributes string) (NativeContent, error) {
+	if body == "" {
+		return NativeContent{}, newMappingError(partMissingCode, requestStage, bodyPart, fmt.Errorf("Missing %v of the article", bodyPart))
+	}
+	if attributes == "" {
+		return NativeContent{}, newMappingError(partMissingCode, requestStage, attributesPart, fmt.Errorf("Missing %v of the article", attributesPart))
+	}
+	return NativeContent{
+		Uuid:       uuid,
+		Type:       compoundStory,
+		Value:      base64.StdEncoding.EncodeToString([]byte(body)),
+		Attributes: attributes,
+	}, nil
+}
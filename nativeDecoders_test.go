@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sampleNativeParts returns the uuid, body XML and attributes XML of the sample article.
+func sampleNativeParts(t *testing.T) (string, string, string) {
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	var native NativeContent
+	assert.NoError(t, json.Unmarshal(article, &native))
+	body, err := base64.StdEncoding.DecodeString(native.Value)
+	assert.NoError(t, err)
+	return native.Uuid, string(body), native.Attributes
+}
+
+func withoutProlog(document string) string {
+	return document[strings.Index(document, "<ObjectMetadata"):]
+}
+
+func postMap(t *testing.T, contentType string, body []byte) *httptest.ResponseRecorder {
+	request, err := http.NewRequest("POST", "/map", bytes.NewReader(body))
+	assert.NoError(t, err)
+	request.Header.Set("Content-Type", contentType)
+	imageSetMapper := newImageSetMapper(defaultArticleToImageSetMapper{}, defaultAttributesMapper{}, defaultImageSetToJSONMapper{})
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(newHTTPMappingHandler(defaultMessageToNativeMapper{}, imageSetMapper, nil).handle).ServeHTTP(recorder, request)
+	return recorder
+}
+
+func assertSampleImageSets(t *testing.T, recorder *httptest.ResponseRecorder) {
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var imageSets []JSONImageSet
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &imageSets))
+	assert.Len(t, imageSets, 2)
+}
+
+func TestNativeFromXMLBundle_CDATA(t *testing.T) {
+	uuid, body, attributes := sampleNativeParts(t)
+	bundle := `<native-article uuid="` + uuid + `"><body><![CDATA[` + body + `]]></body><attributes><![CDATA[` + attributes + `]]></attributes></native-article>`
+
+	native, err := nativeFromXMLBundle([]byte(bundle))
+
+	assert.NoError(t, err)
+	assert.Equal(t, uuid, native.Uuid)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(strings.TrimSpace(body))), native.Value)
+	assert.Equal(t, strings.TrimSpace(attributes), native.Attributes)
+}
+
+func TestNativeFromXMLBundle_InlineElements(t *testing.T) {
+	uuid, _, attributes := sampleNativeParts(t)
+	bundle := `<native-article uuid="` + uuid + `">
+  <body><doc><story><text><body><p>Text</p></body></text></story></doc></body>
+  <attributes>` + withoutProlog(attributes) + `</attributes>
+</native-article>`
+
+	native, err := nativeFromXMLBundle([]byte(bundle))
+
+	assert.NoError(t, err)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("<doc><story><text><body><p>Text</p></body></text></story></doc>")), native.Value)
+	assert.True(t, strings.HasPrefix(native.Attributes, "<ObjectMetadata>"))
+}
+
+func TestNativeFromXMLBundle_MissingPart(t *testing.T) {
+	_, err := nativeFromXMLBundle([]byte(`<native-article uuid="c17e8abe-1df8-11e7-942c-4a4c42b3072e"><body><doc/></body></native-article>`))
+	assert.EqualError(t, err, "Missing attributes of the article")
+}
+
+func TestHttpHandler_XMLBundle(t *testing.T) {
+	uuid, body, attributes := sampleNativeParts(t)
+	bundle := `<native-article uuid="` + uuid + `"><body><![CDATA[` + body + `]]></body><attributes>` + withoutProlog(attributes) + `</attributes></native-article>`
+	assertSampleImageSets(t, postMap(t, "application/xml; charset=utf-8", []byte(bundle)))
+
+	recorder := postMap(t, "text/xml", []byte(`<native-article>`))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `{"message":"Error reading XML bundle.`)
+	assert.Contains(t, recorder.Body.String(), `"code":"INVALID_REQUEST"`)
+}
+
+func TestHttpHandler_Multipart(t *testing.T) {
+	uuid, body, attributes := sampleNativeParts(t)
+	form := new(bytes.Buffer)
+	writer := multipart.NewWriter(form)
+	assert.NoError(t, writer.WriteField("uuid", uuid))
+	bodyFile, err := writer.CreateFormFile("body", "body.xml")
+	assert.NoError(t, err)
+	_, err = bodyFile.Write([]byte(body))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WriteField("attributes", attributes))
+	assert.NoError(t, writer.Close())
+
+	assertSampleImageSets(t, postMap(t, writer.FormDataContentType(), form.Bytes()))
+}
+
+func TestHttpHandler_MultipartMissingPart(t *testing.T) {
+	form := new(bytes.Buffer)
+	writer := multipart.NewWriter(form)
+	assert.NoError(t, writer.WriteField("uuid", "c17e8abe-1df8-11e7-942c-4a4c42b3072e"))
+	assert.NoError(t, writer.Close())
+
+	recorder := postMap(t, writer.FormDataContentType(), form.Bytes())
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `{"message":"Error reading multipart article. Missing body of the article","code":"PART_MISSING","stage":"request","field":"body"`)
+}
+
+func TestHttpHandler_NativeJSONWithContentType(t *testing.T) {
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	assertSampleImageSets(t, postMap(t, "application/json;charset=utf-8", article))
+}
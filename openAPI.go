@@ -0,0 +1,228 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	trans "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/Financial-Times/uuid-utils-go"
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const apiPath = "/__api"
+
+// openAPIDocument describes every route of the service. It's served on apiPath and requests are validated against it.
+//
+//go:embed api/openapi.yml
+var openAPIDocument []byte
+
+// openAPI is the part of an OpenAPI document the requests are validated against.
+type openAPI struct {
+	Paths      map[string]map[string]*openAPIOperation `yaml:"paths"`
+	Components struct {
+		Parameters    map[string]openAPIParameter    `yaml:"parameters"`
+		RequestBodies map[string]*openAPIRequestBody `yaml:"requestBodies"`
+	} `yaml:"components"`
+}
+
+type openAPIOperation struct {
+	Parameters  []openAPIParameter  `yaml:"parameters"`
+	RequestBody *openAPIRequestBody `yaml:"requestBody"`
+}
+
+type openAPIParameter struct {
+	Ref      string `yaml:"$ref"`
+	Name     string `yaml:"name"`
+	In       string `yaml:"in"`
+	Required bool   `yaml:"required"`
+	Schema   struct {
+		Type   string   `yaml:"type"`
+		Format string   `yaml:"format"`
+		Enum   []string `yaml:"enum"`
+	} `yaml:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Ref      string                 `yaml:"$ref"`
+	Required bool                   `yaml:"required"`
+	Content  map[string]interface{} `yaml:"content"`
+}
+
+// parseOpenAPI reads the document, resolving the references to its parameters and request bodies.
+func parseOpenAPI(document []byte) (*openAPI, error) {
+	api := &openAPI{}
+	err := yaml.Unmarshal(document, api)
+	if err != nil {
+		return nil, err
+	}
+	for path, operations := range api.Paths {
+		for method, operation := range operations {
+			for i, parameter := range operation.Parameters {
+				if parameter.Ref == "" {
+					continue
+				}
+				resolved, found := api.Components.Parameters[strings.TrimPrefix(parameter.Ref, "#/components/parameters/")]
+				if !found {
+					return nil, fmt.Errorf("Parameter %v of %v %v isn't defined", parameter.Ref, method, path)
+				}
+				operation.Parameters[i] = resolved
+			}
+			if operation.RequestBody != nil && operation.RequestBody.Ref != "" {
+				resolved, found := api.Components.RequestBodies[strings.TrimPrefix(operation.RequestBody.Ref, "#/components/requestBodies/")]
+				if !found {
+					return nil, fmt.Errorf("Request body %v of %v %v isn't defined", operation.RequestBody.Ref, method, path)
+				}
+				operation.RequestBody = resolved
+			}
+		}
+	}
+	return api, nil
+}
+
+// operation returns the operation of the path template matching the path, with the values of the path parameters. It
+// returns nil when the document has no such operation.
+func (api *openAPI) operation(method string, path string) (*openAPIOperation, map[string]string) {
+	if operations, found := api.Paths[path]; found {
+		return operations[strings.ToLower(method)], map[string]string{}
+	}
+	segments := strings.Split(path, "/")
+	for template, operations := range api.Paths {
+		templateSegments := strings.Split(template, "/")
+		if len(templateSegments) != len(segments) {
+			continue
+		}
+		values := map[string]string{}
+		for i, templateSegment := range templateSegments {
+			if strings.HasPrefix(templateSegment, "{") && strings.HasSuffix(templateSegment, "}") && segments[i] != "" {
+				values[strings.Trim(templateSegment, "{}")] = segments[i]
+			} else if templateSegment != segments[i] {
+				values = nil
+				break
+			}
+		}
+		if values != nil {
+			return operations[strings.ToLower(method)], values
+		}
+	}
+	return nil, nil
+}
+
+// requestValidator rejects the requests that don't match their operation in the OpenAPI document. Requests without
+// an operation are left to the router, which doesn't route them either.
+type requestValidator struct {
+	api  *openAPI
+	next http.Handler
+}
+
+func newRequestValidator(api *openAPI, next http.Handler) *requestValidator {
+	return &requestValidator{api: api, next: next}
+}
+
+func (v *requestValidator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	operation, pathValues := v.api.operation(r.Method, r.URL.Path)
+	if operation == nil {
+		v.next.ServeHTTP(w, r)
+		return
+	}
+	err := v.validate(r, operation, pathValues)
+	if err != nil {
+		tid := trans.GetTransactionIDFromRequest(r)
+		logEvent(requestEvent, tid).WithFields(logrus.Fields{"method": r.Method, "path": r.URL.Path}).WithError(err).Info("Rejected request not matching the OpenAPI document.")
+		w.Header().Add("Content-Type", "application/json;charset=utf-8")
+		w.Header().Add(trans.TransactionIDHeader, tid)
+		writeError(w, err, tid)
+		return
+	}
+	v.next.ServeHTTP(w, r)
+}
+
+func (v *requestValidator) validate(r *http.Request, operation *openAPIOperation, pathValues map[string]string) *mappingError {
+	for _, parameter := range operation.Parameters {
+		var value string
+		switch parameter.In {
+		case "path":
+			value = pathValues[parameter.Name]
+		case "query":
+			value = r.URL.Query().Get(parameter.Name)
+		case "header":
+			value = r.Header.Get(parameter.Name)
+		}
+		err := parameter.validate(value)
+		if err != nil {
+			return newMappingError(invalidRequestCode, requestStage, parameter.Name, err)
+		}
+	}
+	body := operation.RequestBody
+	if body == nil {
+		return nil
+	}
+	if body.Required && r.ContentLength == 0 {
+		return newMappingError(invalidRequestCode, requestStage, "body", errors.New("The request body is required."))
+	}
+	mediaType := requestMediaType(r)
+	for accepted := range body.Content {
+		if acceptsMediaType(accepted, mediaType) {
+			return nil
+		}
+	}
+	return newMappingError(invalidRequestCode, requestStage, "Content-Type", fmt.Errorf("Content-Type %v isn't accepted.", r.Header.Get("Content-Type")))
+}
+
+func (p openAPIParameter) validate(value string) error {
+	if value == "" {
+		if p.Required {
+			return fmt.Errorf("The %v parameter %v is required.", p.In, p.Name)
+		}
+		return nil
+	}
+	if len(p.Schema.Enum) != 0 && !contains(p.Schema.Enum, value) {
+		return fmt.Errorf("%v=%v isn't one of %v.", p.Name, value, strings.Join(p.Schema.Enum, ", "))
+	}
+	switch p.Schema.Type {
+	case "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%v=%v isn't a boolean.", p.Name, value)
+		}
+	case "integer":
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("%v=%v isn't an integer.", p.Name, value)
+		}
+	}
+	if p.Schema.Format == "uuid" {
+		if err := uuidutils.ValidateUUID(value); err != nil {
+			return fmt.Errorf("%v=%v isn't a uuid.", p.Name, value)
+		}
+	}
+	return nil
+}
+
+// acceptsMediaType tells whether the media range of the document, like application/json, text/* or */*, covers the
+// media type of a request.
+func acceptsMediaType(mediaRange string, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	return strings.HasSuffix(mediaRange, "/*") && mediaType != "" && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*"))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func serveOpenAPIDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/x-yaml;charset=utf-8")
+	_, err := w.Write(openAPIDocument)
+	if err != nil {
+		logEvent(requestEvent, "").WithError(err).Warn("Couldn't write to response.")
+	}
+}
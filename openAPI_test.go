@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAPI_DocumentsEveryRoute(t *testing.T) {
+	api, err := parseOpenAPI(openAPIDocument)
+	assert.NoError(t, err)
+	store, cleanup := newTestImageSetStore(t)
+	defer cleanup()
+	r := newRouting(newHTTPMappingHandler(nil, nil, nil), newBatchMappingHandler(nil, nil, 0, 1), newValidationHandler(nil, nil), newDiffHandler(nil, nil),
+		newImageSetLookupHandler(store), newPublishHandler(nil, nil, testPublishAPIKey), newDryRunMessages(1), initializeHealthCheck(true, true))
+
+	routes := 0
+	err = r.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		assert.NoError(t, err)
+		methods := []string{"GET"}
+		if methodHandler, ok := route.GetHandler().(handlers.MethodHandler); ok {
+			methods = methods[:0]
+			for method := range methodHandler {
+				methods = append(methods, method)
+			}
+		}
+		for _, method := range methods {
+			assert.NotNil(t, api.Paths[path][strings.ToLower(method)], "%v %v isn't in the OpenAPI document", method, path)
+		}
+		routes++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, len(api.Paths), routes, "Every path of the OpenAPI document should be routed")
+}
+
+func validatedRequest(t *testing.T, method string, target string, contentType string, body string) *httptest.ResponseRecorder {
+	api, err := parseOpenAPI(openAPIDocument)
+	assert.NoError(t, err)
+	validator := newRequestValidator(api, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	request, err := http.NewRequest(method, target, bytes.NewReader([]byte(body)))
+	assert.NoError(t, err)
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	recorder := httptest.NewRecorder()
+	validator.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestRequestValidator_PassesMatchingRequests(t *testing.T) {
+	assert.Equal(t, http.StatusNoContent, validatedRequest(t, "POST", "/map?view=publication", "application/json", "{}").Code)
+	assert.Equal(t, http.StatusNoContent, validatedRequest(t, "POST", "/map", "", "{}").Code)
+	assert.Equal(t, http.StatusNoContent, validatedRequest(t, "POST", "/publish?dryRun=true", "text/xml", "<native-article/>").Code)
+	assert.Equal(t, http.StatusNoContent, validatedRequest(t, "GET", "/image-sets/4ec94836-0d00-325d-9005-c9aa67f68963/origin", "", "").Code)
+	assert.Equal(t, http.StatusNoContent, validatedRequest(t, "GET", "/not-documented", "", "").Code, "Unknown paths are left to the router")
+}
+
+func TestRequestValidator_RejectsRequestsNotMatching(t *testing.T) {
+	tests := []struct {
+		method        string
+		target        string
+		contentType   string
+		body          string
+		expectedField string
+	}{
+		{"POST", "/map?view=everything", "application/json", "{}", "view"},
+		{"POST", "/map", "application/json", "", "body"},
+		{"POST", "/publish?dryRun=maybe", "application/json", "{}", "dryRun"},
+		{"GET", "/image-sets/not-a-uuid", "", "", "uuid"},
+		{"GET", "/articles/1234/image-sets", "", "", "uuid"},
+	}
+	for _, test := range tests {
+		recorder := validatedRequest(t, test.method, test.target, test.contentType, test.body)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, test.target)
+		assert.Contains(t, recorder.Body.String(), `"code":"INVALID_REQUEST","stage":"request","field":"`+test.expectedField+`"`, test.target)
+	}
+}
+
+func TestAcceptsMediaType(t *testing.T) {
+	assert.True(t, acceptsMediaType("*/*", ""))
+	assert.True(t, acceptsMediaType("application/xml", "application/xml"))
+	assert.True(t, acceptsMediaType("text/*", "text/xml"))
+	assert.False(t, acceptsMediaType("text/*", "application/xml"))
+	assert.False(t, acceptsMediaType("application/json", ""))
+}
+
+func TestServeOpenAPIDocument(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", apiPath, nil)
+	assert.NoError(t, err)
+	serveOpenAPIDocument(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, openAPIDocument, recorder.Body.Bytes())
+}
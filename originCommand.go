@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jawher/mow.cli"
+)
+
+// originLookup returns where the image-set was mapped from, or nil when it was never mapped.
+type originLookup func(imageSetUUID string) (*imageSetOrigin, error)
+
+// originCommand looks up which article and Methode element image-sets were mapped from, asking the running service,
+// or reading the image-set store of a stopped one.
+func (a *app) originCommand(cmd *cli.Cmd) {
+	cmd.Spec = "[--service-url | --store-path] [--timeout] UUID..."
+	serviceURL := cmd.String(cli.StringOpt{
+		Name:   "service-url",
+		Desc:   "Base URL of the running service, its /image-sets/{uuid}/origin endpoint is used.",
+		EnvVar: "IMAGE_SET_SERVICE_URL",
+	})
+	storePath := cmd.String(cli.StringOpt{
+		Name:   "store-path",
+		Desc:   "Image-set store file of a stopped service, or a copy of it. The running service keeps it locked.",
+		EnvVar: "IMAGE_SET_STORE_PATH",
+	})
+	timeoutSeconds := cmd.Int(cli.IntOpt{
+		Name:  "timeout",
+		Value: 5,
+		Desc:  "Seconds to wait for each response of the service, or to open the store.",
+	})
+	uuids := cmd.Strings(cli.StringsArg{
+		Name: "UUID",
+		Desc: "Image-set uuids to look up.",
+	})
+	cmd.Action = func() {
+		timeout := time.Duration(*timeoutSeconds) * time.Second
+		var lookup originLookup
+		switch {
+		case *serviceURL != "":
+			lookup = serviceOrigin(&http.Client{Timeout: timeout}, *serviceURL)
+		case *storePath == "":
+			logEvent(storeEvent, "").Fatal("Neither a service URL nor an image-set store path provided. Quitting...")
+		default:
+			store, err := openReadOnlyImageSetStore(*storePath, timeout)
+			if err != nil {
+				logEvent(storeEvent, "").WithError(err).Fatal("Couldn't open image-set store. Quitting...")
+			}
+			defer store.close()
+			lookup = store.origin
+		}
+		if printOrigins(lookup, *uuids, os.Stdout) != 0 {
+			cli.Exit(1)
+		}
+	}
+}
+
+// serviceOrigin looks image-sets up with the /image-sets/{uuid}/origin endpoint of the service at serviceURL.
+func serviceOrigin(client *http.Client, serviceURL string) originLookup {
+	baseURL := strings.TrimRight(serviceURL, "/")
+	return func(imageSetUUID string) (*imageSetOrigin, error) {
+		resp, err := client.Get(baseURL + "/image-sets/" + imageSetUUID + "/origin")
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			origin := &imageSetOrigin{}
+			if err := json.NewDecoder(resp.Body).Decode(origin); err != nil {
+				return nil, fmt.Errorf("Couldn't decode response of the service. %v", err)
+			}
+			return origin, nil
+		case http.StatusNotFound:
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("Unexpected response status=%v from the service.", resp.StatusCode)
+		}
+	}
+}
+
+// printOrigins writes the origin of each image-set as a JSON line, and returns how many couldn't be found.
+func printOrigins(lookup originLookup, uuids []string, w io.Writer) int {
+	encoder := json.NewEncoder(w)
+	missing := 0
+	for _, uuid := range uuids {
+		origin, err := lookup(uuid)
+		if err != nil {
+			logrus.WithField(uuidField, uuid).WithError(err).Error("Couldn't read origin of image-set.")
+			missing++
+			continue
+		}
+		if origin == nil {
+			logrus.WithField(uuidField, uuid).Error("No image-set was mapped with this uuid.")
+			missing++
+			continue
+		}
+		if err := encoder.Encode(origin); err != nil {
+			logrus.WithField(uuidField, uuid).WithError(err).Error("Couldn't write origin of image-set.")
+			missing++
+		}
+	}
+	return missing
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	prometheusMetricsPath = "/metrics"
+	metricsNamespace      = "image_set_mapper"
+)
+
+// Reasons a consumed article was ignored, as the reason label of messagesIgnored.
+const (
+	ignoredOrigin      = "origin"
+	ignoredTimestamp   = "timestamp"
+	ignoredType        = "type"
+	ignoredStale       = "stale"
+	ignoredNoImageSets = "no_image_sets"
+)
+
+// Limiters whose sends wait for a token, as the limiter label of sendThrottledSeconds.
+const (
+	serviceLimiter = "service"
+	replayLimiter  = "replay"
+)
+
+// The pipeline metrics are registered with the default prometheus registry and served on prometheusMetricsPath, next
+// to the metrics of the go runtime and the process. The ones about messages only count what was consumed, while
+// mappings are counted whichever endpoint or message they were made for.
+var (
+	messagesConsumed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_consumed_total",
+		Help:      "Messages consumed from the queue.",
+	})
+	messagesIgnored = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_ignored_total",
+		Help:      "Consumed messages that published no image-set, by reason: origin, timestamp, type, stale or no_image_sets.",
+	}, []string{"reason"})
+	mappingFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mapping_failures_total",
+		Help:      "Articles that couldn't be mapped, by the stage of the pipeline that failed.",
+	}, []string{"stage"})
+	imageSetsProduced = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_sets_produced_total",
+		Help:      "Image-sets mapped from articles.",
+	})
+	sendFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "send_failures_total",
+		Help:      "Image-set and relations messages that couldn't be sent, after their retries.",
+	})
+	articleProcessingSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "article_processing_seconds",
+		Help:      "Time from consuming an article to having published it, or given up on it.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	sendThrottledSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "send_throttled_seconds_total",
+		Help:      "Time sends spent waiting for the rate limiter, by limiter: service, or replay for the replay command.",
+	}, []string{"limiter"})
+	staleArticlesSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stale_articles_skipped_total",
+		Help:      "Versions of articles older than the latest one published that were skipped, whether consumed or sent to /publish.",
+	})
+	imageSetsPerArticle = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_sets_per_article",
+		Help:      "Image-sets mapped from each article.",
+		Buckets:   []float64{0, 1, 2, 3, 5, 8, 13, 21},
+	})
+)
+
+// observePublication counts what happened to a consumed article. Failures before the image-set mapper, which counts
+// its own, are counted here.
+func observePublication(report *publicationReport) {
+	messagesConsumed.Inc()
+	if report.ignored != "" {
+		messagesIgnored.WithLabelValues(report.ignored).Inc()
+	}
+	if report.mappingErr != nil && report.mappingErr.stage == nativeStage {
+		mappingFailures.WithLabelValues(nativeStage).Inc()
+	}
+	observeSends(report)
+}
+
+// observeSends counts the messages of an article that couldn't be sent, whether it was consumed or sent to /publish.
+func observeSends(report *publicationReport) {
+	for _, imageSet := range report.ImageSets {
+		if imageSet.Outcome == failedOutcome {
+			sendFailures.Inc()
+		}
+	}
+	if report.Relations == failedOutcome {
+		sendFailures.Inc()
+	}
+}
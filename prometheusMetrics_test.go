@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func consumedSampleArticle(t *testing.T, origin string) consumer.Message {
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	m := articleMessage("2017-05-15T15:54:32.166Z", map[string]string{"Origin-System-Id": origin})
+	m.Body = string(article)
+	return m
+}
+
+func TestPipelineMetrics_CountConsumedAndIgnoredMessages(t *testing.T) {
+	q, _ := newPublishTestQueue(nil)
+	consumed := testutil.ToFloat64(messagesConsumed)
+	ignored := testutil.ToFloat64(messagesIgnored.WithLabelValues(ignoredOrigin))
+	produced := testutil.ToFloat64(imageSetsProduced)
+
+	assert.NoError(t, q.onMessage(consumedSampleArticle(t, "http://cmdb.ft.com/systems/wordpress")))
+	assert.NoError(t, q.onMessage(consumedSampleArticle(t, methodeSystemOrigin)))
+
+	assert.Equal(t, consumed+2, testutil.ToFloat64(messagesConsumed))
+	assert.Equal(t, ignored+1, testutil.ToFloat64(messagesIgnored.WithLabelValues(ignoredOrigin)))
+	assert.Equal(t, produced+2, testutil.ToFloat64(imageSetsProduced))
+}
+
+func TestPipelineMetrics_CountSendFailures(t *testing.T) {
+	q, _ := newPublishTestQueue(errors.New("The queue is down."))
+	failures := testutil.ToFloat64(sendFailures)
+
+	assert.Error(t, q.onMessage(consumedSampleArticle(t, methodeSystemOrigin)))
+
+	assert.Equal(t, failures+2, testutil.ToFloat64(sendFailures))
+}
+
+func TestPipelineMetrics_CountSendFailuresOfPublishEndpoint(t *testing.T) {
+	q, _ := newPublishTestQueue(errors.New("The queue is down."))
+	failures := testutil.ToFloat64(sendFailures)
+	produced := testutil.ToFloat64(imageSetsProduced)
+	consumed := testutil.ToFloat64(messagesConsumed)
+
+	recorder := postPublish(t, q, "", testPublishAPIKey)
+
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+	assert.Equal(t, failures+2, testutil.ToFloat64(sendFailures))
+	assert.Equal(t, produced+2, testutil.ToFloat64(imageSetsProduced))
+	assert.Equal(t, consumed, testutil.ToFloat64(messagesConsumed), "Nothing was consumed")
+}
+
+func TestPipelineMetrics_CountMappingFailuresByStage(t *testing.T) {
+	q, _ := newPublishTestQueue(nil)
+	nativeFailures := testutil.ToFloat64(mappingFailures.WithLabelValues(nativeStage))
+	bodyFailures := testutil.ToFloat64(mappingFailures.WithLabelValues(bodyStage))
+
+	m := articleMessage("2017-05-15T15:54:32.166Z", nil)
+	m.Body = "not json"
+	assert.NoError(t, q.onMessage(m))
+	_, err := q.imageSetMapper.Map(NativeContent{Uuid: testArticleUUID, Value: "***"}, "2017-05-15T15:54:32.166Z", "tid_test")
+	assert.Error(t, err)
+
+	assert.Equal(t, nativeFailures+1, testutil.ToFloat64(mappingFailures.WithLabelValues(nativeStage)))
+	assert.Equal(t, bodyFailures+1, testutil.ToFloat64(mappingFailures.WithLabelValues(bodyStage)))
+}
+
+func TestPipelineMetrics_Endpoint(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", prometheusMetricsPath, nil)
+	assert.NoError(t, err)
+	promhttp.Handler().ServeHTTP(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "# TYPE image_set_mapper_messages_consumed_total counter")
+	assert.Contains(t, recorder.Body.String(), "# TYPE image_set_mapper_article_processing_seconds histogram")
+	assert.Contains(t, recorder.Body.String(), "# TYPE image_set_mapper_image_sets_per_article histogram")
+}
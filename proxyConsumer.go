@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/message-queue-gonsumer/consumer"
+	trans "github.com/Financial-Times/transactionid-utils-go"
+)
+
+const (
+	kafkaProxyContentType = "application/vnd.kafka.v1+json"
+	defaultBackoffPeriod  = 8 * time.Second
+)
+
+// proxyConsumer reads messages through the kafka REST proxy like consumer.Consumer does, but it never lets the proxy
+// commit on its own. Offsets are committed only after every message of a batch has been handled successfully.
+// When handling fails the consumer instance is dropped, so the uncommitted messages are delivered again.
+type proxyConsumer struct {
+	config   consumer.QueueConfig
+	handler  func(m consumer.Message) error
+	client   *http.Client
+	backoff  time.Duration
+	shutdown chan struct{}
+	stopOnce sync.Once
+
+	instanceURI string
+}
+
+type proxyConsumerInstance struct {
+	InstanceID string `json:"instance_id"`
+	BaseURI    string `json:"base_uri"`
+}
+
+type proxyMessage struct {
+	Value string `json:"value"`
+}
+
+func newProxyConsumer(config consumer.QueueConfig, handler func(m consumer.Message) error, client *http.Client) *proxyConsumer {
+	backoff := defaultBackoffPeriod
+	if config.BackoffPeriod > 0 {
+		backoff = time.Duration(config.BackoffPeriod) * time.Second
+	}
+	return &proxyConsumer{
+		config:   config,
+		handler:  handler,
+		client:   client,
+		backoff:  backoff,
+		shutdown: make(chan struct{}),
+	}
+}
+
+func (c *proxyConsumer) Start() {
+	for {
+		select {
+		case <-c.shutdown:
+			c.destroyInstance()
+			return
+		default:
+		}
+		if !c.consumeOnce() {
+			c.waitBackoff()
+		}
+	}
+}
+
+// Stop ends consumption once the current batch is handled. Calling it again does nothing.
+func (c *proxyConsumer) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.shutdown)
+	})
+}
+
+func (c *proxyConsumer) ConnectivityCheck() (string, error) {
+	req, err := c.newRequest("GET", c.config.Addrs[0]+"/topics", nil)
+	if err != nil {
+		return "Error connecting to consumer proxy", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "Error connecting to consumer proxy", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "Error connecting to consumer proxy", fmt.Errorf("Unexpected response status %d", resp.StatusCode)
+	}
+	return "Connectivity to consumer proxy is OK.", nil
+}
+
+// consumeOnce handles one batch of messages and reports whether it's worth asking for the next one straight away.
+func (c *proxyConsumer) consumeOnce() bool {
+	if c.instanceURI == "" {
+		err := c.createInstance()
+		if err != nil {
+			logEvent(queueEvent, "").WithField("group", c.config.Group).WithError(err).Error("Couldn't create consumer instance on queue proxy.")
+			return false
+		}
+	}
+	msgs, err := c.consume()
+	if err != nil {
+		logEvent(queueEvent, "").WithField("topic", c.config.Topic).WithError(err).Error("Couldn't consume messages from queue proxy.")
+		c.destroyInstance()
+		return false
+	}
+	if len(msgs) == 0 {
+		return false
+	}
+	for _, msg := range msgs {
+		err = c.handler(msg)
+		if err != nil {
+			logEvent(consumeEvent, msg.Headers[trans.TransactionIDHeader]).WithField("count", len(msgs)).WithError(err).Error("Message couldn't be processed, offsets won't be committed and the batch will be consumed again.")
+			c.destroyInstance()
+			return false
+		}
+	}
+	err = c.commitOffsets()
+	if err != nil {
+		logEvent(queueEvent, "").WithError(err).Error("Couldn't commit offsets to queue proxy.")
+		c.destroyInstance()
+		return false
+	}
+	return true
+}
+
+func (c *proxyConsumer) waitBackoff() {
+	select {
+	case <-c.shutdown:
+	case <-time.After(c.backoff):
+	}
+}
+
+func (c *proxyConsumer) createInstance() error {
+	offset := c.config.Offset
+	if offset == "" {
+		offset = "largest"
+	}
+	body := fmt.Sprintf(`{"auto.offset.reset": "%v", "auto.commit.enable": "%v"}`, offset, strconv.FormatBool(c.config.AutoCommitEnable))
+	respBody, err := c.do("POST", c.config.Addrs[0]+"/consumers/"+c.config.Group, []byte(body), http.StatusOK)
+	if err != nil {
+		return err
+	}
+	var instance proxyConsumerInstance
+	err = json.Unmarshal(respBody, &instance)
+	if err != nil {
+		return fmt.Errorf("Couldn't decode consumer instance. %v", err)
+	}
+	if instance.InstanceID == "" {
+		return errors.New("Queue proxy returned no consumer instance id")
+	}
+	c.instanceURI = c.config.Addrs[0] + "/consumers/" + c.config.Group + "/instances/" + instance.InstanceID
+	return nil
+}
+
+func (c *proxyConsumer) destroyInstance() {
+	if c.instanceURI == "" {
+		return
+	}
+	_, err := c.do("DELETE", c.instanceURI, nil, http.StatusNoContent)
+	if err != nil {
+		logEvent(queueEvent, "").WithError(err).Warn("Couldn't destroy consumer instance on queue proxy.")
+	}
+	c.instanceURI = ""
+}
+
+func (c *proxyConsumer) consume() ([]consumer.Message, error) {
+	respBody, err := c.do("GET", c.instanceURI+"/topics/"+c.config.Topic, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var proxyMsgs []proxyMessage
+	err = json.Unmarshal(respBody, &proxyMsgs)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode messages. %v", err)
+	}
+	msgs := make([]consumer.Message, 0, len(proxyMsgs))
+	for _, proxyMsg := range proxyMsgs {
+		msg, err := parseProxyMessage(proxyMsg.Value)
+		if err != nil {
+			logEvent(consumeEvent, "").WithError(err).Warn("Skipping message that couldn't be parsed.")
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (c *proxyConsumer) commitOffsets() error {
+	_, err := c.do("POST", c.instanceURI+"/offsets", nil, http.StatusOK)
+	return err
+}
+
+func (c *proxyConsumer) do(method string, uri string, body []byte, expectedStatus int) ([]byte, error) {
+	req, err := c.newRequest(method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected response status %d from %v %v: %s", resp.StatusCode, method, uri, respBody)
+	}
+	return respBody, nil
+}
+
+func (c *proxyConsumer) newRequest(method string, uri string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", kafkaProxyContentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.config.Queue != "" {
+		req.Host = c.config.Queue
+	}
+	if c.config.AuthorizationKey != "" {
+		req.Header.Set("Authorization", c.config.AuthorizationKey)
+	}
+	return req, nil
+}
+
+// parseProxyMessage decodes a base64 value holding an FTMSG/1.0 message.
+func parseProxyMessage(value string) (consumer.Message, error) {
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return consumer.Message{}, fmt.Errorf("Couldn't decode message value as base64. %v", err)
+	}
+	return parseFTMessage(string(raw))
+}
+
+// parseFTMessage reads an FTMSG/1.0 message: a version line, header lines and the body separated from the headers
+// by an empty line.
+func parseFTMessage(raw string) (consumer.Message, error) {
+	normalised := strings.Replace(raw, "\r\n", "\n", -1)
+	parts := strings.SplitN(normalised, "\n\n", 2)
+	if len(parts) != 2 {
+		return consumer.Message{}, errors.New("Message has no empty line between headers and body")
+	}
+	headers := make(map[string]string)
+	for _, line := range strings.Split(parts[0], "\n")[1:] {
+		keyValue := strings.SplitN(line, ":", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		headers[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+	}
+	return consumer.Message{Headers: headers, Body: parts[1]}, nil
+}
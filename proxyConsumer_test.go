@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeQueueProxy keeps one topic and the committed offset of one consumer group, and hands out messages to consumer
+// instances starting from that offset, the same way the kafka REST proxy does.
+type fakeQueueProxy struct {
+	sync.Mutex
+	messages        []string
+	committed       int
+	instances       map[string]int
+	createdCount    int
+	polls           int
+	autoCommitAsked []string
+}
+
+func newFakeQueueProxy(bodies ...string) *fakeQueueProxy {
+	p := &fakeQueueProxy{instances: make(map[string]int)}
+	for i, body := range bodies {
+		raw := fmt.Sprintf("FTMSG/1.0\r\nX-Request-Id: tid_%d\r\nOrigin-System-Id: %v\r\n\r\n%v", i, methodeSystemOrigin, body)
+		p.messages = append(p.messages, base64.StdEncoding.EncodeToString([]byte(raw)))
+	}
+	return p
+}
+
+func (p *fakeQueueProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/topics":
+		w.Write([]byte(`["NativeCmsPublicationEvents"]`))
+	case r.Method == "POST" && len(parts) == 2:
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		p.autoCommitAsked = append(p.autoCommitAsked, body["auto.commit.enable"])
+		p.createdCount++
+		id := fmt.Sprintf("instance-%d", p.createdCount)
+		p.instances[id] = p.committed
+		fmt.Fprintf(w, `{"instance_id":"%v","base_uri":"http://internal/consumers/%v/instances/%v"}`, id, parts[1], id)
+	case r.Method == "GET" && len(parts) == 6:
+		position, found := p.instances[parts[3]]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		p.polls++
+		msgs := make([]proxyMessage, 0)
+		for _, value := range p.messages[position:] {
+			msgs = append(msgs, proxyMessage{Value: value})
+		}
+		p.instances[parts[3]] = len(p.messages)
+		json.NewEncoder(w).Encode(msgs)
+	case r.Method == "POST" && len(parts) == 5 && parts[4] == "offsets":
+		p.committed = p.instances[parts[3]]
+		w.Write([]byte("[]"))
+	case r.Method == "DELETE" && len(parts) == 4:
+		delete(p.instances, parts[3])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (p *fakeQueueProxy) pollCount() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.polls
+}
+
+func (p *fakeQueueProxy) committedOffset() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.committed
+}
+
+type recordingHandler struct {
+	sync.Mutex
+	bodies []string
+	failOn string
+}
+
+func (h *recordingHandler) handle(m consumer.Message) error {
+	h.Lock()
+	defer h.Unlock()
+	h.bodies = append(h.bodies, m.Body)
+	if m.Body == h.failOn {
+		return errors.New("couldn't send image-sets")
+	}
+	return nil
+}
+
+func (h *recordingHandler) handled() []string {
+	h.Lock()
+	defer h.Unlock()
+	return append([]string{}, h.bodies...)
+}
+
+func newTestProxyConsumer(addr string, handler func(m consumer.Message) error) *proxyConsumer {
+	c := newProxyConsumer(consumer.QueueConfig{
+		Addrs: []string{addr},
+		Group: "methode-article-image-set-mapper",
+		Topic: "NativeCmsPublicationEvents",
+		Queue: "kafka",
+	}, handler, http.DefaultClient)
+	c.backoff = 10 * time.Millisecond
+	return c
+}
+
+func runUntil(c *proxyConsumer, condition func() bool) {
+	done := make(chan struct{})
+	go func() {
+		c.Start()
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Stop()
+	<-done
+}
+
+func TestProxyConsumer_CommitsAfterSuccessfulBatch(t *testing.T) {
+	proxy := newFakeQueueProxy("article-1", "article-2")
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	handler := &recordingHandler{}
+	c := newTestProxyConsumer(server.URL, handler.handle)
+	runUntil(c, func() bool { return proxy.committedOffset() == 2 })
+
+	assert.Equal(t, []string{"article-1", "article-2"}, handler.handled())
+	assert.Equal(t, 2, proxy.committedOffset())
+	assert.Equal(t, []string{"false"}, proxy.autoCommitAsked, "Consumer instance should be created with auto commit disabled")
+
+	restarted := &recordingHandler{}
+	polls := proxy.pollCount()
+	runUntil(newTestProxyConsumer(server.URL, restarted.handle), func() bool { return proxy.pollCount() > polls })
+	assert.Empty(t, restarted.handled(), "Committed messages shouldn't be delivered again after restart")
+}
+
+func TestProxyConsumer_RedeliversAfterFailedProcessing(t *testing.T) {
+	proxy := newFakeQueueProxy("article-1", "article-2", "article-3")
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	failing := &recordingHandler{failOn: "article-2"}
+	runUntil(newTestProxyConsumer(server.URL, failing.handle), func() bool { return len(failing.handled()) >= 2 })
+	assert.Equal(t, 0, proxy.committedOffset(), "Nothing should be committed when an article couldn't be published")
+
+	restarted := &recordingHandler{}
+	runUntil(newTestProxyConsumer(server.URL, restarted.handle), func() bool { return proxy.committedOffset() == 3 })
+	assert.Equal(t, []string{"article-1", "article-2", "article-3"}, restarted.handled())
+	assert.Equal(t, 3, proxy.committedOffset())
+}
+
+func TestProxyConsumer_StopTwice(t *testing.T) {
+	proxy := newFakeQueueProxy("article-1")
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	handler := &recordingHandler{}
+	c := newTestProxyConsumer(server.URL, handler.handle)
+	runUntil(c, func() bool { return proxy.committedOffset() == 1 })
+
+	assert.NotPanics(t, c.Stop)
+}
+
+func TestProxyConsumer_ConnectivityCheck(t *testing.T) {
+	server := httptest.NewServer(newFakeQueueProxy())
+	defer server.Close()
+
+	_, err := newTestProxyConsumer(server.URL, nil).ConnectivityCheck()
+	assert.NoError(t, err)
+}
+
+func TestProxyConsumer_ConnectivityCheckFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	_, err := newTestProxyConsumer(server.URL, nil).ConnectivityCheck()
+	assert.Error(t, err)
+}
+
+func TestParseProxyMessage(t *testing.T) {
+	raw := "FTMSG/1.0\r\nX-Request-Id: tid_test\r\nMessage-Timestamp: 2017-05-15T15:54:32.166Z\r\n\r\n{\"uuid\":\"c17e8abe-1df8-11e7-942c-4a4c42b3072e\"}"
+	msg, err := parseProxyMessage(base64.StdEncoding.EncodeToString([]byte(raw)))
+	assert.NoError(t, err)
+	assert.Equal(t, "tid_test", msg.Headers["X-Request-Id"])
+	assert.Equal(t, "2017-05-15T15:54:32.166Z", msg.Headers["Message-Timestamp"])
+	assert.Equal(t, `{"uuid":"c17e8abe-1df8-11e7-942c-4a4c42b3072e"}`, msg.Body)
+}
+
+func TestParseProxyMessage_ErrorOnBadValue(t *testing.T) {
+	_, err := parseProxyMessage("not base64!")
+	assert.Error(t, err)
+}
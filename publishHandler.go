@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Financial-Times/message-queue-gonsumer/consumer"
+	trans "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/Sirupsen/logrus"
+)
+
+const dryRunParam = "dryRun"
+
+// publishHandler republishes a native article on request, through the same pipeline as the consumed messages. It's
+// only served with an API key, given as the Authorization header of the requests.
+type publishHandler struct {
+	defaultHTTPMappingHandler
+	apiKey string
+}
+
+func newPublishHandler(messageToNativeMapper MessageToNativeMapper, queue *defaultQueue, apiKey string) *publishHandler {
+	return &publishHandler{
+		defaultHTTPMappingHandler: defaultHTTPMappingHandler{messageToNativeMapper: messageToNativeMapper, queue: queue},
+		apiKey:                    apiKey,
+	}
+}
+
+// handle reads the article like /map and publishes it as if it was consumed with the request headers. Its
+// Origin-System-Id defaults to the first accepted one, Message-Timestamp to now, and X-Force-Publish publishes an
+// older version than the last one published.
+func (h *publishHandler) handle(w http.ResponseWriter, r *http.Request) {
+	tid := trans.GetTransactionIDFromRequest(r)
+	w.Header().Add("Content-Type", "application/json;charset=utf-8")
+	w.Header().Add(trans.TransactionIDHeader, tid)
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(h.apiKey)) != 1 {
+		logEvent(requestEvent, tid).Warn("Refused publication with a missing or wrong Authorization header.")
+		writeError(w, newMappingError(unauthorizedCode, requestStage, "Authorization", errors.New("A valid Authorization header is required to publish.")), tid)
+		return
+	}
+	dryRun := false
+	if value := r.URL.Query().Get(dryRunParam); value != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, newMappingError(invalidRequestCode, requestStage, dryRunParam, fmt.Errorf("%v=%v isn't a boolean.", dryRunParam, value)), tid)
+			return
+		}
+	}
+
+	native, ok := h.readNative(w, r, tid)
+	if !ok {
+		return
+	}
+	body, err := json.Marshal(native)
+	if err != nil {
+		writeError(w, newInternalError(nativeStage, fmt.Errorf("Couldn't marshall native article to JSON. %v", err)), tid)
+		return
+	}
+
+	logEvent(requestEvent, tid).WithFields(logrus.Fields{uuidField: native.Uuid, "dry_run": dryRun}).Info("Publishing article on request.")
+	report, err := h.queue.publish(consumer.Message{Headers: h.messageHeaders(r, tid), Body: string(body)}, dryRun)
+	observeSends(report)
+	if report.mappingErr != nil {
+		writeError(w, report.mappingErr, tid)
+		return
+	}
+	status := http.StatusOK
+	if err != nil {
+		publishErr := newMappingError(publishFailedCode, publishStage, "", err)
+		errorMessage := newHTTPErrorMessage(publishErr, tid)
+		report.Error = &errorMessage
+		status = publishErr.status()
+	}
+	marshaledReport, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, newInternalError(responseStage, fmt.Errorf("Couldn't marshall publication report to JSON. %v", err)), tid)
+		return
+	}
+	w.WriteHeader(status)
+	_, err = w.Write(marshaledReport)
+	if err != nil {
+		logEvent(requestEvent, tid).WithError(err).Warn("Couldn't write to response.")
+	}
+}
+
+// messageHeaders are the headers of the message the request is published as.
+func (h *publishHandler) messageHeaders(r *http.Request, tid string) map[string]string {
+	headers := map[string]string{
+		trans.TransactionIDHeader: tid,
+		"Origin-System-Id":        r.Header.Get("Origin-System-Id"),
+	}
+	if headers["Origin-System-Id"] == "" {
+		headers["Origin-System-Id"] = h.queue.acceptedOrigins[0]
+	}
+	names := append([]string{"Message-Timestamp", forcePublishHeader}, h.queue.passThroughHeaders...)
+	for _, name := range names {
+		if value := r.Header.Get(name); value != "" {
+			headers[name] = value
+		}
+	}
+	return headers
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Financial-Times/message-queue-go-producer/producer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testPublishAPIKey = "test-key"
+
+func postPublish(t *testing.T, q *defaultQueue, query string, apiKey string) *httptest.ResponseRecorder {
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	request, err := http.NewRequest("POST", "/publish"+query, bytes.NewReader(article))
+	assert.NoError(t, err)
+	request.Header.Set("X-Request-Id", "tid_test")
+	request.Header.Set("Authorization", apiKey)
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(newPublishHandler(defaultMessageToNativeMapper{}, q, testPublishAPIKey).handle).ServeHTTP(recorder, request)
+	return recorder
+}
+
+func newPublishTestQueue(sendErr error) (*defaultQueue, *mockProducer) {
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(sendErr)
+	imageSetMapper := newImageSetMapper(defaultArticleToImageSetMapper{}, defaultAttributesMapper{}, defaultImageSetToJSONMapper{})
+	return newQueue(nil, mockedProducer, defaultMessageToNativeMapper{}, imageSetMapper), mockedProducer
+}
+
+func readPublicationReport(t *testing.T, recorder *httptest.ResponseRecorder) publicationReport {
+	var report publicationReport
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report), recorder.Body.String())
+	return report
+}
+
+func TestPublishHandler_RefusesWrongKey(t *testing.T) {
+	q, mockedProducer := newPublishTestQueue(nil)
+	for _, apiKey := range []string{"", "wrong-key"} {
+		recorder := postPublish(t, q, "", apiKey)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), `"code":"UNAUTHORIZED"`)
+	}
+	mockedProducer.AssertNotCalled(t, "SendMessage", mock.Anything, mock.Anything)
+}
+
+func TestPublishHandler_Publishes(t *testing.T) {
+	q, mockedProducer := newPublishTestQueue(nil)
+	recorder := postPublish(t, q, "", testPublishAPIKey)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	report := readPublicationReport(t, recorder)
+	assert.Equal(t, "c17e8abe-1df8-11e7-942c-4a4c42b3072e", report.ArticleUUID)
+	assert.False(t, report.DryRun)
+	assert.Len(t, report.ImageSets, 2)
+	for _, imageSet := range report.ImageSets {
+		assert.Equal(t, sentOutcome, imageSet.Outcome)
+		assert.NotEmpty(t, imageSet.MethodeID)
+	}
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 2)
+	mockedProducer.AssertCalled(t, "SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool {
+		return msg.Headers["X-Request-Id"] == "tid_test" && msg.Headers["Origin-System-Id"] == methodeSystemOrigin
+	}))
+}
+
+func TestPublishHandler_DryRunSendsNothing(t *testing.T) {
+	q, mockedProducer := newPublishTestQueue(nil)
+	q.articleVersions = newArticleVersions(10)
+	recorder := postPublish(t, q, "?dryRun=true", testPublishAPIKey)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	report := readPublicationReport(t, recorder)
+	assert.True(t, report.DryRun)
+	assert.Len(t, report.ImageSets, 2)
+	assert.Equal(t, dryRunOutcome, report.ImageSets[0].Outcome)
+	mockedProducer.AssertNotCalled(t, "SendMessage", mock.Anything, mock.Anything)
+	assert.Empty(t, q.articleVersions.entries, "A dry-run shouldn't remember the article version")
+}
+
+func TestPublishHandler_ReportsFailedSends(t *testing.T) {
+	q, _ := newPublishTestQueue(errors.New("queue unavailable"))
+	recorder := postPublish(t, q, "", testPublishAPIKey)
+
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+	report := readPublicationReport(t, recorder)
+	assert.Equal(t, publishFailedCode, report.Error.Code)
+	assert.Len(t, report.ImageSets, 2)
+	assert.Equal(t, failedOutcome, report.ImageSets[0].Outcome)
+	assert.Equal(t, "queue unavailable", report.ImageSets[0].Error)
+}
+
+func TestPublishHandler_InvalidDryRun(t *testing.T) {
+	q, _ := newPublishTestQueue(nil)
+	recorder := postPublish(t, q, "?dryRun=maybe", testPublishAPIKey)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"field":"dryRun"`)
+}
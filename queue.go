@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/Financial-Times/message-queue-go-producer/producer"
@@ -9,120 +10,446 @@ import (
 	trans "github.com/Financial-Times/transactionid-utils-go"
 	"github.com/Sirupsen/logrus"
 	gouuid "github.com/satori/go.uuid"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	methodeSystemOrigin = "http://cmdb.ft.com/systems/methode-web-pub"
-	dateFormat          = "2006-01-02T15:04:05.000Z0700"
-	contentURIBase      = "http://methode-article-image-set-mapper.svc.ft.com/image-set/model/"
+	methodeSystemOrigin   = "http://cmdb.ft.com/systems/methode-web-pub"
+	defaultMessageType    = "cms-content-published"
+	defaultContentType    = "application/json"
+	defaultContentURIBase = "http://methode-article-image-set-mapper.svc.ft.com/image-set/model/"
+	relationsMessageType  = "cms-article-image-sets"
+	forcePublishHeader    = "X-Force-Publish"
 )
 
 type queue interface {
-	onMessage(m consumer.Message)
+	onMessage(m consumer.Message) error
 }
 
 type defaultQueue struct {
 	messageConsumer   consumer.MessageConsumer
 	messageProducer   producer.MessageProducer
+	relationsProducer producer.MessageProducer
 	consumerWaitGroup sync.WaitGroup
 
 	messageToNativeMapper MessageToNativeMapper
 	imageSetMapper        ImageSetMapper
+
+	atomicPublish        bool
+	publishRetries       int
+	publishRetryInterval time.Duration
+
+	acceptedOrigins []string
+	outgoingOrigin  string
+
+	invalidTimestampPolicy string
+
+	messageType        string
+	contentType        string
+	contentURIBase     string
+	extraHeaders       map[string]string
+	passThroughHeaders []string
+
+	articleVersions *articleVersions
+	imageSetStore   *imageSetStore
+	// dryRun is set when the whole service runs dry: messages are kept instead of sent, so nothing is recorded either.
+	dryRun bool
+
+	marshal func(v interface{}) ([]byte, error)
 }
 
 func newQueue(messageConsumer consumer.MessageConsumer, messageProducer producer.MessageProducer,
-	messageToNativeMapper MessageToNativeMapper, imageSetMapper ImageSetMapper) defaultQueue {
-	queue := defaultQueue{
-		messageConsumer:       messageConsumer,
-		messageProducer:       messageProducer,
-		messageToNativeMapper: messageToNativeMapper,
-		imageSetMapper:        imageSetMapper,
-		consumerWaitGroup:     sync.WaitGroup{},
+	messageToNativeMapper MessageToNativeMapper, imageSetMapper ImageSetMapper) *defaultQueue {
+	queue := &defaultQueue{
+		messageConsumer:        messageConsumer,
+		messageProducer:        messageProducer,
+		messageToNativeMapper:  messageToNativeMapper,
+		imageSetMapper:         imageSetMapper,
+		acceptedOrigins:        []string{methodeSystemOrigin},
+		outgoingOrigin:         methodeSystemOrigin,
+		invalidTimestampPolicy: replaceInvalidTimestamps,
+		messageType:            defaultMessageType,
+		contentType:            defaultContentType,
+		contentURIBase:         defaultContentURIBase,
+		extraHeaders:           map[string]string{},
+		marshal:                json.Marshal,
 	}
 	return queue
 }
 
-func (q defaultQueue) onMessage(m consumer.Message) {
+// onMessage maps and publishes the image-sets of one article. It returns an error only when the publication failed
+// in a way that consuming the same message again could fix, so that its offset is not committed.
+func (q *defaultQueue) onMessage(m consumer.Message) error {
+	start := time.Now()
+	report, err := q.publish(m, false)
+	articleProcessingSeconds.Observe(time.Since(start).Seconds())
+	observePublication(report)
+	return err
+}
+
+// publish runs an article through the pipeline and reports what happened to each of its image-sets. A dry-run maps
+// the article and builds its messages, but doesn't send, record or store anything.
+func (q *defaultQueue) publish(m consumer.Message, dryRun bool) (*publicationReport, error) {
+	report := &publicationReport{DryRun: dryRun, ImageSets: []imageSetOutcome{}}
 	tid := m.Headers[trans.TransactionIDHeader]
 	if tid == "" {
 		tid = trans.NewTransactionID()
-		logrus.Warnf("X-Request-Id not found in kafka message headers. Created now. transactionId=%v", tid)
+		logEvent(consumeEvent, tid).Warn("X-Request-Id not found in kafka message headers. Created now.")
 	}
 
-	if m.Headers["Origin-System-Id"] != methodeSystemOrigin {
-		logrus.Infof("Ignoring message with different originSystemId=%v transactionId=%v ", m.Headers["Origin-System-Id"], tid)
-		return
+	origin := m.Headers["Origin-System-Id"]
+	if !q.isAcceptedOrigin(origin) {
+		logEvent(consumeEvent, tid).WithField("origin_system_id", origin).Info("Ignoring message with different Origin-System-Id.")
+		report.Skipped = fmt.Sprintf("Origin-System-Id %v isn't accepted.", origin)
+		report.ignored = ignoredOrigin
+		return report, nil
 	}
 
-	lastModified := m.Headers["Message-Timestamp"]
-	if lastModified == "" {
-		lastModified = time.Now().Format(dateFormat)
-		logrus.Infof("Last modified date was empty on message, created now. transactionId=%v lastModifiedDate=%v", tid, lastModified)
+	lastModified, madeUp, ok := q.lastModifiedOf(m, tid)
+	if !ok {
+		report.Skipped = "Message-Timestamp is invalid."
+		report.ignored = ignoredTimestamp
+		return report, nil
 	}
 
 	native, err := q.messageToNativeMapper.Map([]byte(m.Body))
 	if err != nil {
-		logrus.Errorf("Error mapping native message. transactionId=%v %v", tid, err)
-		return
+		logEvent(mapEvent, tid).WithField(stageField, nativeStage).WithError(err).Error("Error mapping native message.")
+		report.mappingErr = newMappingError(invalidNativeJSONCode, nativeStage, "", fmt.Errorf("Error mapping native message. %v", err))
+		return report, nil
 	}
+	report.ArticleUUID = native.Uuid
 	if native.Type != compoundStory {
-		logrus.Infof("Ignoring message of type=%v transactionId=%v", native.Type, tid)
-		return
+		logEvent(consumeEvent, tid).WithFields(logrus.Fields{uuidField: native.Uuid, "type": native.Type}).Info("Ignoring message of a type that isn't mapped.")
+		report.Skipped = fmt.Sprintf("Articles of type %v aren't mapped.", native.Type)
+		report.ignored = ignoredType
+		return report, nil
+	}
+	if !madeUp && q.isStale(native.Uuid, lastModified, m.Headers, tid) {
+		report.Skipped = fmt.Sprintf("A newer version than %v was published, %v publishes it anyway.", lastModified, forcePublishHeader)
+		report.ignored = ignoredStale
+		return report, nil
 	}
 
 	imageSets, err := q.imageSetMapper.Map(native, lastModified, tid)
 	if err != nil {
-		logrus.Errorf("Error mapping message to image-sets transactionId=%v %v", tid, err)
-		return
+		report.mappingErr = asMappingError(err, mappingFailedCode, imageSetStage).prefixed("Error mapping the given content.")
+		logEvent(mapEvent, tid).WithFields(logrus.Fields{uuidField: native.Uuid, stageField: report.mappingErr.stage}).WithError(err).Error("Error mapping message to image-sets.")
+		return report, nil
+	}
+	if len(imageSets) == 0 {
+		report.ignored = ignoredNoImageSets
 	}
 
+	msgs, errs := q.publicationMessages(imageSets, lastModified, tid, m.Headers)
+	q.logBuildErrors(imageSets, errs, tid)
+	for _, imageSet := range imageSets {
+		outcome := imageSetOutcome{UUID: imageSet.UUID, MethodeID: imageSet.MethodeID, Outcome: notSentOutcome}
+		if dryRun {
+			outcome.Outcome = dryRunOutcome
+		}
+		if err, found := errs[imageSet.UUID]; found {
+			outcome.Outcome, outcome.Error = notBuiltOutcome, err.Error()
+		}
+		report.ImageSets = append(report.ImageSets, outcome)
+	}
+	if dryRun {
+		logEvent(sendEvent, tid).WithFields(logrus.Fields{uuidField: native.Uuid, "count": len(msgs)}).Info("Dry-run of the publication of image-sets.")
+		if q.relationsProducer != nil {
+			report.Relations = dryRunOutcome
+		}
+		return report, nil
+	}
+
+	q.recordMapping(native.Uuid, imageSets, tid)
+
 	if len(imageSets) == 0 {
-		logrus.Infof("No image-sets were found in this article. transactionId=%v", tid)
-	} else {
-		msgs, errs := q.buildMessages(imageSets, lastModified, tid)
+		logEvent(mapEvent, tid).WithField(uuidField, native.Uuid).Info("No image-sets were found in this article.")
+		return report, q.finishPublication(report, native.Uuid, nil, lastModified, madeUp, tid, q.outgoingOriginFor(origin))
+	}
+
+	if q.atomicPublish {
 		if len(errs) != 0 {
-			for uuid, err := range errs {
-				logrus.Errorf("Couldn't build message for image-set transactionId=%v uuid=%v %v", tid, uuid, err)
-			}
+			logEvent(sendEvent, tid).WithFields(logrus.Fields{uuidField: native.Uuid, "not_built": len(errs), "count": len(imageSets)}).Error("Publication of image-sets aborted. Couldn't build every message, none were sent.")
+			return report, nil
+		}
+		err = q.publishAtomically(msgs, tid, report)
+		if err != nil {
+			logEvent(sendEvent, tid).WithField(uuidField, native.Uuid).WithError(err).Error("Publication of image-sets failed.")
+			return report, err
+		}
+		logEvent(sendEvent, tid).WithFields(logrus.Fields{uuidField: native.Uuid, "count": len(msgs)}).Info("Mapped and sent all image-sets.")
+		return report, q.finishPublication(report, native.Uuid, msgs, lastModified, madeUp, tid, q.outgoingOriginFor(origin))
+	}
+
+	failed := 0
+	for _, msg := range msgs {
+		err = q.messageProducer.SendMessage("", msg.message)
+		if err != nil {
+			logEvent(sendEvent, tid).WithField(uuidField, msg.uuid).WithError(err).Error("Error sending transformed message to queue.")
+			report.outcome(msg.uuid, failedOutcome, err)
+			failed++
+			continue
+		}
+		report.outcome(msg.uuid, sentOutcome, nil)
+		logEvent(sendEvent, tid).WithField(uuidField, msg.uuid).Info("Mapped and sent image-set.")
+	}
+	if failed != 0 {
+		return report, fmt.Errorf("Couldn't send %v of %v image-sets of article uuid=%v transactionId=%v", failed, len(msgs), native.Uuid, tid)
+	}
+	if len(errs) != 0 {
+		// The relations and the stored image-sets would leave out the ones that couldn't be built, dropping what was
+		// published for them before. Consuming the article again wouldn't build them either.
+		logEvent(sendEvent, tid).WithFields(logrus.Fields{uuidField: native.Uuid, "not_built": len(errs), "count": len(imageSets)}).Error("Publication of image-sets left unfinished. Couldn't build every message, relations weren't sent.")
+		return report, nil
+	}
+	return report, q.finishPublication(report, native.Uuid, msgs, lastModified, madeUp, tid, q.outgoingOriginFor(origin))
+}
+
+// isStale reports whether an older version of the article than the latest one published was consumed, for example
+// during a replay or after a rebalance. The X-Force-Publish header publishes it anyway.
+func (q *defaultQueue) isStale(articleUUID string, lastModified string, headers map[string]string, tid string) bool {
+	if q.articleVersions == nil {
+		return false
+	}
+	t, err := time.Parse(uppDateFormat, lastModified)
+	if err != nil {
+		return false
+	}
+	stale, latest := q.articleVersions.isStale(articleUUID, t)
+	if !stale {
+		return false
+	}
+	if strings.EqualFold(headers[forcePublishHeader], "true") {
+		logEvent(consumeEvent, tid).WithFields(logrus.Fields{uuidField: articleUUID, "last_modified": lastModified, "latest_last_modified": latest.Format(uppDateFormat)}).Info("Publishing older version of article on request.")
+		return false
+	}
+	logEvent(consumeEvent, tid).WithFields(logrus.Fields{uuidField: articleUUID, "last_modified": lastModified, "latest_last_modified": latest.Format(uppDateFormat)}).Warn("Skipping stale version of article.")
+	staleArticlesSkipped.Inc()
+	return true
+}
+
+// recordMapping keeps where the image-sets come from, whether they get published or not.
+func (q *defaultQueue) recordMapping(articleUUID string, imageSets []JSONImageSet, tid string) {
+	if q.imageSetStore == nil || q.dryRun || len(imageSets) == 0 {
+		return
+	}
+	if err := q.imageSetStore.mapped(articleUUID, imageSets, time.Now()); err != nil {
+		logEvent(storeEvent, tid).WithField(uuidField, articleUUID).WithError(err).Error("Couldn't record origin of image-sets of article.")
+	}
+}
+
+// finishPublication sends the relations of an article whose image-sets were all sent. Then it remembers its version,
+// unless the last modified date was made up, and stores what was published, unless the service runs dry.
+func (q *defaultQueue) finishPublication(report *publicationReport, articleUUID string, msgs []imageSetMessage, lastModified string, madeUp bool, tid string, originSystemID string) error {
+	err := q.publishRelations(articleUUID, msgs, lastModified, tid, originSystemID)
+	if q.relationsProducer != nil {
+		report.Relations = sentOutcome
+	}
+	if err != nil {
+		report.Relations = failedOutcome
+		return err
+	}
+	if q.dryRun {
+		return nil
+	}
+	if q.articleVersions != nil && !madeUp {
+		if t, err := time.Parse(uppDateFormat, lastModified); err == nil {
+			q.articleVersions.published(articleUUID, t)
+		}
+	}
+	if q.imageSetStore != nil {
+		imageSets := make([]JSONImageSet, 0, len(msgs))
+		for _, msg := range msgs {
+			imageSets = append(imageSets, msg.imageSet)
+		}
+		if err := q.imageSetStore.published(articleUUID, imageSets); err != nil {
+			logEvent(storeEvent, tid).WithField(uuidField, articleUUID).WithError(err).Error("Couldn't store published image-sets of article.")
 		}
-		for uuid, msg := range msgs {
-			err = q.messageProducer.SendMessage("", msg)
-			if err != nil {
-				logrus.Errorf("Error sending transformed message to queue transactionId=%v uuid=%v %v", tid, uuid, err)
-				continue
+	}
+	return nil
+}
+
+// publishRelations sends the event relating an article to the image-sets published for it, in body order. An article
+// left without image-sets gets an event with none, so that earlier relations can be dropped. Nothing is sent when no
+// relations producer is configured.
+func (q *defaultQueue) publishRelations(articleUUID string, msgs []imageSetMessage, lastModified string, tid string, originSystemID string) error {
+	if q.relationsProducer == nil {
+		return nil
+	}
+	msg, err := q.buildRelationsMessage(articleUUID, msgs, lastModified, tid, originSystemID)
+	if err != nil {
+		logEvent(relationsEvent, tid).WithField(uuidField, articleUUID).WithError(err).Error("Couldn't build relations message for article.")
+		return nil
+	}
+	err = q.relationsProducer.SendMessage(articleUUID, msg)
+	if err != nil {
+		return fmt.Errorf("Couldn't send relations of article uuid=%v transactionId=%v %v", articleUUID, tid, err)
+	}
+	logEvent(relationsEvent, tid).WithFields(logrus.Fields{uuidField: articleUUID, "count": len(msgs)}).Info("Sent relations of article to image-sets.")
+	return nil
+}
+
+func (q *defaultQueue) buildRelationsMessage(articleUUID string, msgs []imageSetMessage, lastModified string, tid string, originSystemID string) (producer.Message, error) {
+	links := make([]articleImageSetLink, 0, len(msgs))
+	for _, msg := range msgs {
+		links = append(links, articleImageSetLink{UUID: msg.uuid, MethodeID: msg.methodeID})
+	}
+	body := articleImageSetsBody{
+		ArticleUUID:      articleUUID,
+		ImageSets:        links,
+		PublishReference: tid,
+		LastModified:     lastModified,
+	}
+	marshaledBody, err := json.Marshal(body)
+	if err != nil {
+		return producer.Message{}, err
+	}
+	headers := map[string]string{
+		"X-Request-Id":      tid,
+		"Message-Timestamp": lastModified,
+		"Message-Id":        gouuid.NewV4().String(),
+		"Message-Type":      relationsMessageType,
+		"Content-Type":      "application/json",
+		"Origin-System-Id":  originSystemID,
+	}
+	return producer.Message{Headers: headers, Body: string(marshaledBody)}, nil
+}
+
+// lastModifiedOf returns the Message-Timestamp of a message normalised to uppDateFormat, and whether it was made up
+// because the message had none or an invalid one. A made up date says nothing about the version of the article, so it
+// is neither compared with nor remembered as the latest version. It returns false when the timestamp is invalid and
+// such messages are rejected.
+func (q *defaultQueue) lastModifiedOf(m consumer.Message, tid string) (string, bool, bool) {
+	lastModified := m.Headers["Message-Timestamp"]
+	if lastModified == "" {
+		lastModified = time.Now().UTC().Format(uppDateFormat)
+		logEvent(consumeEvent, tid).WithField("last_modified", lastModified).Info("Last modified date was empty on message, created now.")
+		return lastModified, true, true
+	}
+	normalised, err := normaliseTimestamp(lastModified)
+	if err == nil {
+		return normalised, false, true
+	}
+	if q.invalidTimestampPolicy == rejectInvalidTimestamps {
+		logEvent(consumeEvent, tid).WithError(err).Error("Ignoring message with invalid timestamp.")
+		return "", false, false
+	}
+	normalised = time.Now().UTC().Format(uppDateFormat)
+	logEvent(consumeEvent, tid).WithField("last_modified", normalised).WithError(err).Warn("Last modified date was invalid on message, replaced with now.")
+	return normalised, true, true
+}
+
+// publishAtomically sends the messages in order, stopping at the first one that still fails after its retries. Sent
+// messages can't be taken back, so a publication stopped partway reports and logs the outcome of every image-set.
+func (q *defaultQueue) publishAtomically(msgs []imageSetMessage, tid string, report *publicationReport) error {
+	sent := make([]string, 0, len(msgs))
+	for i, msg := range msgs {
+		attempts, err := q.sendWithRetries(msg.message, msg.uuid, tid)
+		report.attempts(msg.uuid, attempts)
+		if err != nil {
+			report.outcome(msg.uuid, failedOutcome, err)
+			for _, unsent := range msgs[i+1:] {
+				report.outcome(unsent.uuid, notSentOutcome, fmt.Errorf("Not sent, sending image-set uuid=%v failed before.", msg.uuid))
 			}
-			logrus.Infof("Mapped and sent for uuid=%v transactionId=%v", uuid, tid)
+			q.logOutcomes(report, tid)
+			return fmt.Errorf("Gave up sending image-set uuid=%v after %v attempts, stopped with sent=%v unsent=%v. %v", msg.uuid, attempts, sent, len(msgs)-len(sent), err)
 		}
+		report.outcome(msg.uuid, sentOutcome, nil)
+		sent = append(sent, msg.uuid)
 	}
+	return nil
 }
 
-func (q defaultQueue) buildMessages(imageSets []JSONImageSet, lastModified string, tid string) (map[string]producer.Message, map[string]error) {
+// sendWithRetries returns how many times the message was sent, the last one failing when there's an error.
+func (q *defaultQueue) sendWithRetries(msg producer.Message, uuid string, tid string) (int, error) {
+	attempts := 1
+	err := q.messageProducer.SendMessage("", msg)
+	for ; err != nil && attempts <= q.publishRetries; attempts++ {
+		logEvent(sendEvent, tid).WithFields(logrus.Fields{uuidField: uuid, "attempt": attempts}).WithError(err).Warn("Error sending transformed message to queue, retrying.")
+		time.Sleep(q.publishRetryInterval)
+		err = q.messageProducer.SendMessage("", msg)
+	}
+	return attempts, err
+}
+
+func (q *defaultQueue) logOutcomes(report *publicationReport, tid string) {
+	for _, outcome := range report.ImageSets {
+		log := logEvent(sendEvent, tid).WithFields(logrus.Fields{uuidField: outcome.UUID, "article_uuid": report.ArticleUUID, "outcome": outcome.Outcome, "attempts": outcome.Attempts})
+		if outcome.Error != "" {
+			log = log.WithField("error", outcome.Error)
+		}
+		log.Warn("Outcome of image-set in a publication stopped partway.")
+	}
+}
+
+func (q *defaultQueue) isAcceptedOrigin(origin string) bool {
+	for _, accepted := range q.acceptedOrigins {
+		if origin == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// outgoingOriginFor returns the configured origin for outgoing messages, or the incoming one when none is configured.
+func (q *defaultQueue) outgoingOriginFor(incomingOrigin string) string {
+	if q.outgoingOrigin == "" {
+		return incomingOrigin
+	}
+	return q.outgoingOrigin
+}
+
+// publicationMessages builds the messages sending the image-sets of an article consumed with the given headers.
+// /map?view=publication returns them too, so what it shows is what gets published.
+func (q *defaultQueue) publicationMessages(imageSets []JSONImageSet, lastModified string, tid string, inboundHeaders map[string]string) ([]imageSetMessage, map[string]error) {
+	return q.buildMessages(imageSets, lastModified, tid, q.outgoingOriginFor(inboundHeaders["Origin-System-Id"]), inboundHeaders)
+}
+
+func (q *defaultQueue) buildMessages(imageSets []JSONImageSet, lastModified string, tid string, originSystemID string, inboundHeaders map[string]string) ([]imageSetMessage, map[string]error) {
 	errs := make(map[string]error, 0)
-	msgs := make(map[string]producer.Message, 0)
+	msgs := make([]imageSetMessage, 0, len(imageSets))
 	for _, imageSet := range imageSets {
-		msg, err := q.buildMessage(imageSet, lastModified, tid)
+		msg, err := q.buildMessage(imageSet, lastModified, tid, originSystemID, inboundHeaders)
 		if err != nil {
 			errs[imageSet.UUID] = err
 			continue
 		}
-		msgs[imageSet.UUID] = msg
+		msgs = append(msgs, imageSetMessage{uuid: imageSet.UUID, methodeID: imageSet.MethodeID, imageSet: imageSet, message: msg})
 	}
 	return msgs, errs
 }
 
-func (q defaultQueue) buildMessage(imageSet JSONImageSet, lastModified, pubRef string) (producer.Message, error) {
-	headers := map[string]string{
-		"X-Request-Id":      pubRef,
-		"Message-Timestamp": lastModified,
-		"Message-Id":        gouuid.NewV4().String(),
-		"Message-Type":      "cms-content-published",
-		"Content-Type":      "application/json",
-		"Origin-System-Id":  methodeSystemOrigin,
+func (q *defaultQueue) logBuildErrors(imageSets []JSONImageSet, errs map[string]error, tid string) {
+	for _, imageSet := range imageSets {
+		if err, found := errs[imageSet.UUID]; found {
+			logEvent(sendEvent, tid).WithField(uuidField, imageSet.UUID).WithError(err).Error("Couldn't build message for image-set.")
+		}
 	}
+}
+
+// buildMessage builds the publication message of one image-set. The static extra headers and the inbound headers
+// selected for pass-through are added first, so they can't replace the headers the mapper sets itself.
+func (q *defaultQueue) buildMessage(imageSet JSONImageSet, lastModified, pubRef string, originSystemID string, inboundHeaders map[string]string) (producer.Message, error) {
+	headers := make(map[string]string)
+	for name, value := range q.extraHeaders {
+		headers[name] = value
+	}
+	for _, name := range q.passThroughHeaders {
+		if value, found := inboundHeaders[name]; found {
+			headers[name] = value
+		}
+	}
+	headers["X-Request-Id"] = pubRef
+	headers["Message-Timestamp"] = lastModified
+	headers["Message-Id"] = gouuid.NewV4().String()
+	headers["Message-Type"] = q.messageType
+	headers["Content-Type"] = q.contentType
+	headers["Origin-System-Id"] = originSystemID
 	body := publicationMessageBody{
-		ContentURI:   contentURIBase + imageSet.UUID,
+		ContentURI:   q.contentURIBase + imageSet.UUID,
 		Payload:      imageSet,
 		LastModified: lastModified,
 	}
@@ -133,8 +460,8 @@ func (q defaultQueue) buildMessage(imageSet JSONImageSet, lastModified, pubRef s
 	return producer.Message{Headers: headers, Body: string(marshaledBody)}, nil
 }
 
-func (q defaultQueue) unsafeJSONMarshal(v interface{}) ([]byte, error) {
-	b, err := json.Marshal(v)
+func (q *defaultQueue) unsafeJSONMarshal(v interface{}) ([]byte, error) {
+	b, err := q.marshal(v)
 	if err != nil {
 		return nil, err
 	}
@@ -143,7 +470,7 @@ func (q defaultQueue) unsafeJSONMarshal(v interface{}) ([]byte, error) {
 	return b, nil
 }
 
-func (q defaultQueue) startConsuming() {
+func (q *defaultQueue) startConsuming() {
 	q.consumerWaitGroup.Add(1)
 	go func() {
 		q.messageConsumer.Start()
@@ -151,7 +478,18 @@ func (q defaultQueue) startConsuming() {
 	}()
 }
 
-func (q defaultQueue) stop() {
+// stop asks the consumer to stop and waits until it has finished the message in-flight, or until ctx is done.
+func (q *defaultQueue) stop(ctx context.Context) error {
 	q.messageConsumer.Stop()
-	q.consumerWaitGroup.Wait()
+	drained := make(chan struct{})
+	go func() {
+		q.consumerWaitGroup.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Gave up waiting for the consumer to stop. %v", ctx.Err())
+	}
 }
@@ -1,7 +1,84 @@
 package main
 
+import "github.com/Financial-Times/message-queue-go-producer/producer"
+
+// imageSetMessage is a publication message built for one image-set, kept in the order of the article body.
+type imageSetMessage struct {
+	uuid      string
+	methodeID string
+	imageSet  JSONImageSet
+	message   producer.Message
+}
+
 type publicationMessageBody struct {
 	ContentURI   string       `json:"contentUri"`
 	Payload      JSONImageSet `json:"payload"`
 	LastModified string       `json:"lastModified"`
 }
+
+// articleImageSetsBody is the body of the relationship event that lists the image-sets published for an article.
+type articleImageSetsBody struct {
+	ArticleUUID      string                `json:"articleUuid"`
+	ImageSets        []articleImageSetLink `json:"imageSets"`
+	PublishReference string                `json:"publishReference"`
+	LastModified     string                `json:"lastModified"`
+}
+
+type articleImageSetLink struct {
+	UUID      string `json:"uuid"`
+	MethodeID string `json:"methodeId"`
+}
+
+// Outcomes of an image-set in a publicationReport.
+const (
+	sentOutcome     = "sent"
+	failedOutcome   = "failed"
+	notSentOutcome  = "not-sent"
+	notBuiltOutcome = "not-built"
+	dryRunOutcome   = "dry-run"
+)
+
+// publicationReport tells what happened to an article in the publication pipeline. Skipped is why nothing was
+// published, when the article was ignored. Relations is the outcome of the relations event, empty when there's no
+// relations producer. ignored is the reason label of an article ignored, for the metrics.
+type publicationReport struct {
+	ArticleUUID string            `json:"uuid,omitempty"`
+	DryRun      bool              `json:"dryRun"`
+	Skipped     string            `json:"skipped,omitempty"`
+	ImageSets   []imageSetOutcome `json:"imageSets"`
+	Relations   string            `json:"relations,omitempty"`
+	Error       *ErrorMessage     `json:"error,omitempty"`
+	mappingErr  *mappingError
+	ignored     string
+}
+
+type imageSetOutcome struct {
+	UUID      string `json:"uuid"`
+	MethodeID string `json:"methodeId"`
+	Outcome   string `json:"outcome"`
+	Attempts  int    `json:"attempts,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// outcome sets the outcome of the image-set, with the error it failed with.
+func (r *publicationReport) outcome(uuid string, outcome string, err error) {
+	for i := range r.ImageSets {
+		if r.ImageSets[i].UUID == uuid {
+			r.ImageSets[i].Outcome = outcome
+			if err != nil {
+				r.ImageSets[i].Error = err.Error()
+			}
+			return
+		}
+	}
+}
+
+// attempts sets how many times the image-set was sent.
+func (r *publicationReport) attempts(uuid string, attempts int) {
+	for i := range r.ImageSets {
+		if r.ImageSets[i].UUID == uuid {
+			r.ImageSets[i].Attempts = attempts
+			return
+		}
+	}
+}
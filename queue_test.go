@@ -1,13 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"github.com/Financial-Times/message-queue-go-producer/producer"
 	"github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestOnMessage_Ok(t *testing.T) {
@@ -30,7 +33,8 @@ func TestOnMessage_Ok(t *testing.T) {
 	mockedProducer := new(mockProducer)
 	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
 	q := newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
-	q.onMessage(sourceMsg)
+	err := q.onMessage(sourceMsg)
+	assert.NoError(t, err)
 	mockedProducer.AssertCalled(t, "SendMessage", "",
 		mock.MatchedBy(func(msg producer.Message) bool {
 			return strings.Contains(msg.Body, "512c1f3d-e48c-4618-863c-94bc9d913b9b") && strings.Contains(msg.Body, "2017-05-15T15:54:32.166Z")
@@ -151,7 +155,8 @@ func TestOnMessage_WarnIfErrorInImageSetMapper(t *testing.T) {
 	mockedProducer := new(mockProducer)
 	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
 	q := newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
-	q.onMessage(sourceMsg)
+	err := q.onMessage(sourceMsg)
+	assert.NoError(t, err, "Mapping errors won't be fixed by consuming the message again")
 	mockedProducer.AssertNotCalled(t, "SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true }))
 }
 
@@ -180,7 +185,8 @@ func TestOnMessage_OneSendFailureShouldNotAffectOther(t *testing.T) {
 		return strings.Contains(msg.Body, "43dc1ff3-6d6c-41f3-9196-56dcaa554905")
 	})).Return(nil)
 	q := newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
-	q.onMessage(sourceMsg)
+	err := q.onMessage(sourceMsg)
+	assert.Error(t, err, "A failed send should be reported so the message is consumed again")
 	mockedProducer.AssertCalled(t, "SendMessage", "",
 		mock.MatchedBy(func(msg producer.Message) bool {
 			return strings.Contains(msg.Body, "512c1f3d-e48c-4618-863c-94bc9d913b9b") && strings.Contains(msg.Body, "2017-05-15T15:54:32.166Z")
@@ -218,7 +224,7 @@ func TestBuildMessage_Ok(t *testing.T) {
 		FirstPublishedDate: "2017-05-18T02:24:00Z",
 		CanBeDistributed:   "yes",
 		Type:               "ImageSet",
-	}, "2017-05-15T15:54:32.166Z", "tid_test")
+	}, "2017-05-15T15:54:32.166Z", "tid_test", methodeSystemOrigin, nil)
 	assert.NoError(t, err, "Error wasn't expected during buildMessage()")
 	assert.Equal(t, actualMsg.Headers["X-Request-Id"], "tid_test")
 	assert.NotEmpty(t, actualMsg.Headers["Message-Id"])
@@ -267,22 +273,544 @@ func TestBuildMessages_Ok(t *testing.T) {
 			CanBeDistributed:   "yes",
 			Type:               "ImageSet",
 		},
-	}, "2017-05-15T15:54:32.166Z", "tid_test")
+	}, "2017-05-15T15:54:32.166Z", "tid_test", methodeSystemOrigin, nil)
 	if len(errs) != 0 {
 		assert.Fail(t, "errors are not empty")
 	}
-	assert.Equal(t, actualMsgs["5a8f3f37-3098-48f7-811a-f69d12f2b1be"].Headers["X-Request-Id"], "tid_test")
-	assert.NotEmpty(t, actualMsgs["5a8f3f37-3098-48f7-811a-f69d12f2b1be"].Headers["Message-Id"])
-	assert.Equal(t, actualMsgs["5a8f3f37-3098-48f7-811a-f69d12f2b1be"].Headers["Message-Type"], "cms-content-published")
-	assert.Equal(t, actualMsgs["5a8f3f37-3098-48f7-811a-f69d12f2b1be"].Headers["Content-Type"], "application/json")
-	assert.Equal(t, actualMsgs["5a8f3f37-3098-48f7-811a-f69d12f2b1be"].Headers["Origin-System-Id"], methodeSystemOrigin)
-	assert.Equal(t, actualMsgs["5a8f3f37-3098-48f7-811a-f69d12f2b1be"].Body, `{"contentUri":"http://methode-article-image-set-mapper.svc.ft.com/image-set/model/5a8f3f37-3098-48f7-811a-f69d12f2b1be","payload":{"uuid":"5a8f3f37-3098-48f7-811a-f69d12f2b1be","identifiers":[{"authority":"http://api.ft.com/system/FTCOM-METHODE","identifierValue":"5a8f3f37-3098-48f7-811a-f69d12f2b1be"}],"members":[{"uuid":"8ff1c7f4-a80b-4b8d-8821-b07ff1bfdf87"},{"uuid":"3bea853a-89b8-4831-80b3-8384e962f5dc"},{"uuid":"c6eeea75-748e-4b1c-a046-6e4c9d81ff25"}],"publishReference":"","lastModified":"","publishedDate":"2017-05-18T02:24:25Z","firstPublishedDate":"2017-05-18T02:24:00Z","canBeDistributed":"yes","type":"ImageSet"},"lastModified":"2017-05-15T15:54:32.166Z"}`)
+	assert.Equal(t, "5a8f3f37-3098-48f7-811a-f69d12f2b1be", actualMsgs[0].uuid)
+	assert.Equal(t, "270c0151-7742-4c1e-b77e-a5557881a042", actualMsgs[1].uuid)
+	assert.Equal(t, actualMsgs[0].message.Headers["X-Request-Id"], "tid_test")
+	assert.NotEmpty(t, actualMsgs[0].message.Headers["Message-Id"])
+	assert.Equal(t, actualMsgs[0].message.Headers["Message-Type"], "cms-content-published")
+	assert.Equal(t, actualMsgs[0].message.Headers["Content-Type"], "application/json")
+	assert.Equal(t, actualMsgs[0].message.Headers["Origin-System-Id"], methodeSystemOrigin)
+	assert.Equal(t, actualMsgs[0].message.Body, `{"contentUri":"http://methode-article-image-set-mapper.svc.ft.com/image-set/model/5a8f3f37-3098-48f7-811a-f69d12f2b1be","payload":{"uuid":"5a8f3f37-3098-48f7-811a-f69d12f2b1be","identifiers":[{"authority":"http://api.ft.com/system/FTCOM-METHODE","identifierValue":"5a8f3f37-3098-48f7-811a-f69d12f2b1be"}],"members":[{"uuid":"8ff1c7f4-a80b-4b8d-8821-b07ff1bfdf87"},{"uuid":"3bea853a-89b8-4831-80b3-8384e962f5dc"},{"uuid":"c6eeea75-748e-4b1c-a046-6e4c9d81ff25"}],"publishReference":"","lastModified":"","publishedDate":"2017-05-18T02:24:25Z","firstPublishedDate":"2017-05-18T02:24:00Z","canBeDistributed":"yes","type":"ImageSet"},"lastModified":"2017-05-15T15:54:32.166Z"}`)
+
+	assert.Equal(t, actualMsgs[1].message.Headers["X-Request-Id"], "tid_test")
+	assert.NotEmpty(t, actualMsgs[1].message.Headers["Message-Id"])
+	assert.Equal(t, actualMsgs[1].message.Headers["Message-Type"], "cms-content-published")
+	assert.Equal(t, actualMsgs[1].message.Headers["Content-Type"], "application/json")
+	assert.Equal(t, actualMsgs[1].message.Headers["Origin-System-Id"], methodeSystemOrigin)
+	assert.Equal(t, actualMsgs[1].message.Body, `{"contentUri":"http://methode-article-image-set-mapper.svc.ft.com/image-set/model/270c0151-7742-4c1e-b77e-a5557881a042","payload":{"uuid":"270c0151-7742-4c1e-b77e-a5557881a042","identifiers":[{"authority":"http://api.ft.com/system/FTCOM-METHODE","identifierValue":"270c0151-7742-4c1e-b77e-a5557881a042"}],"members":[{"uuid":"667ee7f3-4f58-4080-a6f9-9b16b633dea8"},{"uuid":"a0513a50-08d1-43f6-af2b-7e7dc4d40b31"},{"uuid":"47e5a693-cd39-4ede-a016-244e6413a7fa"}],"publishReference":"","lastModified":"","publishedDate":"2017-05-18T02:24:25Z","firstPublishedDate":"2017-05-18T02:24:00Z","canBeDistributed":"yes","type":"ImageSet"},"lastModified":"2017-05-15T15:54:32.166Z"}`)
+
+}
+
+func TestOnMessage_AtomicPublishSendsAll(t *testing.T) {
+	sourceMsg := consumer.Message{
+		Headers: map[string]string{
+			"X-Request-Id":      "tid_test123",
+			"Origin-System-Id":  methodeSystemOrigin,
+			"Message-Timestamp": "2017-05-15T15:54:32.166Z",
+		},
+	}
+	nativeContent := NativeContent{
+		Type:  compoundStory,
+		Value: "",
+	}
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(nativeContent, nil)
+	mockedImageSetMapper := new(mockImageSetMapper)
+	jsonImageSets := []JSONImageSet{JSONImageSet{UUID: "512c1f3d-e48c-4618-863c-94bc9d913b9b"}, JSONImageSet{UUID: "43dc1ff3-6d6c-41f3-9196-56dcaa554905"}}
+	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return(jsonImageSets, nil)
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	q := newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
+	q.atomicPublish = true
+	q.onMessage(sourceMsg)
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 2)
+}
+
+func TestOnMessage_AtomicPublishRetriesFailedSend(t *testing.T) {
+	sourceMsg := consumer.Message{
+		Headers: map[string]string{
+			"X-Request-Id":      "tid_test123",
+			"Origin-System-Id":  methodeSystemOrigin,
+			"Message-Timestamp": "2017-05-15T15:54:32.166Z",
+		},
+	}
+	nativeContent := NativeContent{
+		Type:  compoundStory,
+		Value: "",
+	}
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(nativeContent, nil)
+	mockedImageSetMapper := new(mockImageSetMapper)
+	jsonImageSets := []JSONImageSet{JSONImageSet{UUID: "512c1f3d-e48c-4618-863c-94bc9d913b9b"}}
+	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return(jsonImageSets, nil)
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(errors.New("error sending msg")).Twice()
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	q := newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
+	q.atomicPublish = true
+	q.publishRetries = 3
+	q.onMessage(sourceMsg)
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 3)
+}
+
+func TestOnMessage_AtomicPublishStopsAfterRetriesExhausted(t *testing.T) {
+	sourceMsg := consumer.Message{
+		Headers: map[string]string{
+			"X-Request-Id":      "tid_test123",
+			"Origin-System-Id":  methodeSystemOrigin,
+			"Message-Timestamp": "2017-05-15T15:54:32.166Z",
+		},
+	}
+	nativeContent := NativeContent{
+		Type:  compoundStory,
+		Value: "",
+	}
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(nativeContent, nil)
+	mockedImageSetMapper := new(mockImageSetMapper)
+	jsonImageSets := []JSONImageSet{JSONImageSet{UUID: "512c1f3d-e48c-4618-863c-94bc9d913b9b"}, JSONImageSet{UUID: "43dc1ff3-6d6c-41f3-9196-56dcaa554905"}}
+	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return(jsonImageSets, nil)
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(errors.New("error sending msg"))
+	q := newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
+	q.atomicPublish = true
+	q.publishRetries = 2
+	q.onMessage(sourceMsg)
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 3)
+}
+
+func newImageSetsTestQueue(mockedProducer *mockProducer, imageSetUUIDs ...string) *defaultQueue {
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(NativeContent{Uuid: testArticleUUID, Type: compoundStory}, nil)
+	jsonImageSets := make([]JSONImageSet, 0, len(imageSetUUIDs))
+	for _, uuid := range imageSetUUIDs {
+		jsonImageSets = append(jsonImageSets, JSONImageSet{UUID: uuid})
+	}
+	mockedImageSetMapper := new(mockImageSetMapper)
+	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return(jsonImageSets, nil)
+	return newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
+}
+
+func newAtomicTestQueue(mockedProducer *mockProducer, imageSetUUIDs ...string) *defaultQueue {
+	q := newImageSetsTestQueue(mockedProducer, imageSetUUIDs...)
+	q.atomicPublish = true
+	return q
+}
+
+// failToBuild makes the messages of the given image-sets fail to build.
+func failToBuild(q *defaultQueue, imageSetUUIDs ...string) {
+	q.marshal = func(v interface{}) ([]byte, error) {
+		if body, ok := v.(publicationMessageBody); ok {
+			for _, uuid := range imageSetUUIDs {
+				if body.Payload.UUID == uuid {
+					return nil, errors.New("Can't marshall")
+				}
+			}
+		}
+		return json.Marshal(v)
+	}
+}
+
+func publishWithUnbuiltImageSets(t *testing.T, unbuilt ...string) {
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	mockedRelationsProducer := new(mockProducer)
+	q := newImageSetsTestQueue(mockedProducer, "512c1f3d-e48c-4618-863c-94bc9d913b9b", "43dc1ff3-6d6c-41f3-9196-56dcaa554905")
+	q.relationsProducer = mockedRelationsProducer
+	store, cleanup := newTestImageSetStore(t)
+	defer cleanup()
+	q.imageSetStore = store
+	assert.NoError(t, store.published(testArticleUUID, []JSONImageSet{{UUID: "512c1f3d-e48c-4618-863c-94bc9d913b9b"}, {UUID: "43dc1ff3-6d6c-41f3-9196-56dcaa554905"}}))
+	failToBuild(q, unbuilt...)
+
+	report, err := q.publish(articleMessage("2017-05-15T15:54:32.166Z", nil), false)
+
+	assert.NoError(t, err, "Consuming the article again wouldn't build the messages either")
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 2-len(unbuilt))
+	mockedRelationsProducer.AssertNotCalled(t, "SendMessage", mock.Anything, mock.Anything)
+	assert.Equal(t, notBuiltOutcome, report.ImageSets[1].Outcome)
+	assert.Empty(t, report.Relations)
+	imageSets, found, err := store.articleImageSets(testArticleUUID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Len(t, imageSets, 2, "The image-sets published before should still be stored for the article")
+}
+
+func TestPublish_SomeUnbuiltImageSetsLeaveRelationsAndStoreUnchanged(t *testing.T) {
+	publishWithUnbuiltImageSets(t, "43dc1ff3-6d6c-41f3-9196-56dcaa554905")
+}
+
+func TestPublish_AllUnbuiltImageSetsLeaveRelationsAndStoreUnchanged(t *testing.T) {
+	publishWithUnbuiltImageSets(t, "512c1f3d-e48c-4618-863c-94bc9d913b9b", "43dc1ff3-6d6c-41f3-9196-56dcaa554905")
+}
+
+func TestPublish_AtomicPublishSendsNothingWhenAMessageCantBeBuilt(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	q := newAtomicTestQueue(mockedProducer, "512c1f3d-e48c-4618-863c-94bc9d913b9b", "43dc1ff3-6d6c-41f3-9196-56dcaa554905")
+	failToBuild(q, "43dc1ff3-6d6c-41f3-9196-56dcaa554905")
+
+	report, err := q.publish(articleMessage("2017-05-15T15:54:32.166Z", nil), false)
+
+	assert.NoError(t, err)
+	mockedProducer.AssertNotCalled(t, "SendMessage", mock.Anything, mock.Anything)
+	assert.Equal(t, notSentOutcome, report.ImageSets[0].Outcome)
+	assert.Equal(t, notBuiltOutcome, report.ImageSets[1].Outcome)
+}
+
+func TestPublish_AtomicPublishReportsPartialSend(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil).Once()
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(errors.New("error sending msg"))
+	q := newAtomicTestQueue(mockedProducer, "512c1f3d-e48c-4618-863c-94bc9d913b9b", "43dc1ff3-6d6c-41f3-9196-56dcaa554905", "8c07916c-2577-37b6-b477-291094f992ee")
+	q.publishRetries = 2
+
+	report, err := q.publish(articleMessage("2017-05-15T15:54:32.166Z", nil), false)
+
+	assert.Error(t, err)
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 4)
+	assert.Equal(t, imageSetOutcome{UUID: "512c1f3d-e48c-4618-863c-94bc9d913b9b", Outcome: sentOutcome, Attempts: 1}, report.ImageSets[0])
+	assert.Equal(t, imageSetOutcome{UUID: "43dc1ff3-6d6c-41f3-9196-56dcaa554905", Outcome: failedOutcome, Attempts: 3, Error: "error sending msg"}, report.ImageSets[1])
+	assert.Equal(t, notSentOutcome, report.ImageSets[2].Outcome)
+	assert.Contains(t, report.ImageSets[2].Error, "43dc1ff3-6d6c-41f3-9196-56dcaa554905")
+}
+
+func TestOnMessage_SendsInBodyOrder(t *testing.T) {
+	sourceMsg := consumer.Message{
+		Headers: map[string]string{
+			"X-Request-Id":      "tid_test123",
+			"Origin-System-Id":  methodeSystemOrigin,
+			"Message-Timestamp": "2017-05-15T15:54:32.166Z",
+		},
+	}
+	nativeContent := NativeContent{
+		Type:  compoundStory,
+		Value: "",
+	}
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(nativeContent, nil)
+	mockedImageSetMapper := new(mockImageSetMapper)
+	expectedOrder := []string{
+		"512c1f3d-e48c-4618-863c-94bc9d913b9b",
+		"43dc1ff3-6d6c-41f3-9196-56dcaa554905",
+		"0c2e4d77-6e5b-4e8b-8c4a-0b5c3a0f2a11",
+		"9f3a6b1e-2f0c-4f6a-9d1e-5b7c8e4a3d22",
+		"1d5e7f9a-3b2c-4d6e-8f0a-2c4e6a8b0d33",
+	}
+	jsonImageSets := make([]JSONImageSet, 0, len(expectedOrder))
+	for _, uuid := range expectedOrder {
+		jsonImageSets = append(jsonImageSets, JSONImageSet{UUID: uuid})
+	}
+	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return(jsonImageSets, nil)
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	q := newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
+	q.onMessage(sourceMsg)
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", len(expectedOrder))
+	for i, call := range mockedProducer.Calls {
+		msg := call.Arguments.Get(1).(producer.Message)
+		assert.True(t, strings.Contains(msg.Body, `"contentUri":"`+defaultContentURIBase+expectedOrder[i]+`"`), "SendMessage call %v should be for uuid=%v", i, expectedOrder[i])
+	}
+}
+
+func TestOnMessage_AcceptsConfiguredOrigins(t *testing.T) {
+	replayOrigin := "http://cmdb.ft.com/systems/methode-replay"
+	sourceMsg := consumer.Message{
+		Headers: map[string]string{
+			"X-Request-Id":      "tid_test123",
+			"Origin-System-Id":  replayOrigin,
+			"Message-Timestamp": "2017-05-15T15:54:32.166Z",
+		},
+	}
+	nativeContent := NativeContent{
+		Type:  compoundStory,
+		Value: "",
+	}
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(nativeContent, nil)
+	mockedImageSetMapper := new(mockImageSetMapper)
+	jsonImageSets := []JSONImageSet{JSONImageSet{UUID: "512c1f3d-e48c-4618-863c-94bc9d913b9b"}}
+	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return(jsonImageSets, nil)
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	q := newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
+	q.acceptedOrigins = []string{methodeSystemOrigin, replayOrigin}
+	q.onMessage(sourceMsg)
+	mockedProducer.AssertCalled(t, "SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool {
+		return msg.Headers["Origin-System-Id"] == methodeSystemOrigin
+	}))
+}
+
+func TestOnMessage_PassesThroughOriginWhenNoneConfigured(t *testing.T) {
+	replayOrigin := "http://cmdb.ft.com/systems/methode-replay"
+	sourceMsg := consumer.Message{
+		Headers: map[string]string{
+			"X-Request-Id":      "tid_test123",
+			"Origin-System-Id":  replayOrigin,
+			"Message-Timestamp": "2017-05-15T15:54:32.166Z",
+		},
+	}
+	nativeContent := NativeContent{
+		Type:  compoundStory,
+		Value: "",
+	}
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(nativeContent, nil)
+	mockedImageSetMapper := new(mockImageSetMapper)
+	jsonImageSets := []JSONImageSet{JSONImageSet{UUID: "512c1f3d-e48c-4618-863c-94bc9d913b9b"}}
+	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return(jsonImageSets, nil)
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	q := newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
+	q.acceptedOrigins = []string{replayOrigin}
+	q.outgoingOrigin = ""
+	q.onMessage(sourceMsg)
+	mockedProducer.AssertCalled(t, "SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool {
+		return msg.Headers["Origin-System-Id"] == replayOrigin
+	}))
+}
+
+func TestBuildMessage_ConfiguredTypeHeadersAndContentURI(t *testing.T) {
+	q := newQueue(nil, nil, nil, nil)
+	q.messageType = "cms-content-staged"
+	q.contentType = "application/vnd.ft-upp-image-set+json"
+	q.contentURIBase = "http://methode-article-image-set-mapper-staging.svc.ft.com/image-set/model/"
+	q.extraHeaders = map[string]string{"X-Environment": "staging", "Message-Type": "overridden"}
+	q.passThroughHeaders = []string{"X-Native-Hash", "X-Not-Present", "X-Request-Id"}
+	inboundHeaders := map[string]string{
+		"X-Request-Id":  "tid_inbound",
+		"X-Native-Hash": "f3a1",
+		"X-Other":       "not passed through",
+	}
+
+	actualMsg, err := q.buildMessage(JSONImageSet{UUID: "5a8f3f37-3098-48f7-811a-f69d12f2b1be"}, "2017-05-15T15:54:32.166Z", "tid_test", methodeSystemOrigin, inboundHeaders)
+	assert.NoError(t, err)
+	assert.Equal(t, "cms-content-staged", actualMsg.Headers["Message-Type"], "Extra headers shouldn't replace the configured message type")
+	assert.Equal(t, "application/vnd.ft-upp-image-set+json", actualMsg.Headers["Content-Type"])
+	assert.Equal(t, "staging", actualMsg.Headers["X-Environment"])
+	assert.Equal(t, "f3a1", actualMsg.Headers["X-Native-Hash"])
+	assert.Equal(t, "tid_test", actualMsg.Headers["X-Request-Id"], "Passed through headers shouldn't replace the transaction id")
+	assert.NotContains(t, actualMsg.Headers, "X-Not-Present")
+	assert.NotContains(t, actualMsg.Headers, "X-Other")
+	assert.True(t, strings.HasPrefix(actualMsg.Body, `{"contentUri":"http://methode-article-image-set-mapper-staging.svc.ft.com/image-set/model/5a8f3f37-3098-48f7-811a-f69d12f2b1be"`))
+}
+
+func TestOnMessage_PublishesRelationsInBodyOrder(t *testing.T) {
+	sourceMsg := consumer.Message{
+		Headers: map[string]string{
+			"X-Request-Id":      "tid_test123",
+			"Origin-System-Id":  methodeSystemOrigin,
+			"Message-Timestamp": "2017-05-15T15:54:32.166Z",
+		},
+	}
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(NativeContent{Uuid: "c17e8abe-1df8-11e7-942c-4a4c42b3072e", Type: compoundStory}, nil)
+	mockedImageSetMapper := new(mockImageSetMapper)
+	jsonImageSets := []JSONImageSet{
+		JSONImageSet{UUID: "d8367364-c56b-3599-8787-08e1784b02ce", MethodeID: "U11603547146784PeC"},
+		JSONImageSet{UUID: "84be18d3-4622-3bb1-87b6-33786f12902f", MethodeID: "U12345547146784RfD"},
+	}
+	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return(jsonImageSets, nil)
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	mockedRelationsProducer := new(mockProducer)
+	mockedRelationsProducer.On("SendMessage", "c17e8abe-1df8-11e7-942c-4a4c42b3072e", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	q := newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
+	q.relationsProducer = mockedRelationsProducer
 
-	assert.Equal(t, actualMsgs["270c0151-7742-4c1e-b77e-a5557881a042"].Headers["X-Request-Id"], "tid_test")
-	assert.NotEmpty(t, actualMsgs["270c0151-7742-4c1e-b77e-a5557881a042"].Headers["Message-Id"])
-	assert.Equal(t, actualMsgs["270c0151-7742-4c1e-b77e-a5557881a042"].Headers["Message-Type"], "cms-content-published")
-	assert.Equal(t, actualMsgs["270c0151-7742-4c1e-b77e-a5557881a042"].Headers["Content-Type"], "application/json")
-	assert.Equal(t, actualMsgs["270c0151-7742-4c1e-b77e-a5557881a042"].Headers["Origin-System-Id"], methodeSystemOrigin)
-	assert.Equal(t, actualMsgs["270c0151-7742-4c1e-b77e-a5557881a042"].Body, `{"contentUri":"http://methode-article-image-set-mapper.svc.ft.com/image-set/model/270c0151-7742-4c1e-b77e-a5557881a042","payload":{"uuid":"270c0151-7742-4c1e-b77e-a5557881a042","identifiers":[{"authority":"http://api.ft.com/system/FTCOM-METHODE","identifierValue":"270c0151-7742-4c1e-b77e-a5557881a042"}],"members":[{"uuid":"667ee7f3-4f58-4080-a6f9-9b16b633dea8"},{"uuid":"a0513a50-08d1-43f6-af2b-7e7dc4d40b31"},{"uuid":"47e5a693-cd39-4ede-a016-244e6413a7fa"}],"publishReference":"","lastModified":"","publishedDate":"2017-05-18T02:24:25Z","firstPublishedDate":"2017-05-18T02:24:00Z","canBeDistributed":"yes","type":"ImageSet"},"lastModified":"2017-05-15T15:54:32.166Z"}`)
+	err := q.onMessage(sourceMsg)
+	assert.NoError(t, err)
+	mockedRelationsProducer.AssertNumberOfCalls(t, "SendMessage", 1)
+	msg := mockedRelationsProducer.Calls[0].Arguments.Get(1).(producer.Message)
+	assert.Equal(t, "tid_test123", msg.Headers["X-Request-Id"])
+	assert.Equal(t, "2017-05-15T15:54:32.166Z", msg.Headers["Message-Timestamp"])
+	assert.Equal(t, "cms-article-image-sets", msg.Headers["Message-Type"])
+	assert.Equal(t, "application/json", msg.Headers["Content-Type"])
+	assert.Equal(t, methodeSystemOrigin, msg.Headers["Origin-System-Id"])
+	assert.NotEmpty(t, msg.Headers["Message-Id"])
+	assert.JSONEq(t, `{
+		"articleUuid": "c17e8abe-1df8-11e7-942c-4a4c42b3072e",
+		"imageSets": [
+			{"uuid": "d8367364-c56b-3599-8787-08e1784b02ce", "methodeId": "U11603547146784PeC"},
+			{"uuid": "84be18d3-4622-3bb1-87b6-33786f12902f", "methodeId": "U12345547146784RfD"}
+		],
+		"publishReference": "tid_test123",
+		"lastModified": "2017-05-15T15:54:32.166Z"
+	}`, msg.Body)
+}
 
+func TestOnMessage_PublishesEmptyRelationsWhenNoImageSets(t *testing.T) {
+	sourceMsg := consumer.Message{
+		Headers: map[string]string{
+			"X-Request-Id":      "tid_test123",
+			"Origin-System-Id":  methodeSystemOrigin,
+			"Message-Timestamp": "2017-05-15T15:54:32.166Z",
+		},
+	}
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(NativeContent{Uuid: "c17e8abe-1df8-11e7-942c-4a4c42b3072e", Type: compoundStory}, nil)
+	mockedImageSetMapper := new(mockImageSetMapper)
+	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return([]JSONImageSet{}, nil)
+	mockedRelationsProducer := new(mockProducer)
+	mockedRelationsProducer.On("SendMessage", "c17e8abe-1df8-11e7-942c-4a4c42b3072e", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	q := newQueue(nil, nil, mockedMessageToNativeMapper, mockedImageSetMapper)
+	q.relationsProducer = mockedRelationsProducer
+
+	err := q.onMessage(sourceMsg)
+	assert.NoError(t, err)
+	mockedRelationsProducer.AssertNumberOfCalls(t, "SendMessage", 1)
+	msg := mockedRelationsProducer.Calls[0].Arguments.Get(1).(producer.Message)
+	assert.Contains(t, msg.Body, `"imageSets":[]`)
+}
+
+func TestOnMessage_NoRelationsWhenImageSetSendFails(t *testing.T) {
+	sourceMsg := consumer.Message{
+		Headers: map[string]string{
+			"X-Request-Id":     "tid_test123",
+			"Origin-System-Id": methodeSystemOrigin,
+		},
+	}
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(NativeContent{Uuid: "c17e8abe-1df8-11e7-942c-4a4c42b3072e", Type: compoundStory}, nil)
+	mockedImageSetMapper := new(mockImageSetMapper)
+	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return([]JSONImageSet{JSONImageSet{UUID: "d8367364-c56b-3599-8787-08e1784b02ce"}}, nil)
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(errors.New("couldn't send"))
+	mockedRelationsProducer := new(mockProducer)
+	q := newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
+	q.relationsProducer = mockedRelationsProducer
+
+	err := q.onMessage(sourceMsg)
+	assert.Error(t, err)
+	mockedRelationsProducer.AssertNotCalled(t, "SendMessage", mock.Anything, mock.Anything)
+}
+
+func newTimestampTestQueue(mockedProducer *mockProducer) *defaultQueue {
+	mockedMessageToNativeMapper := new(mockMessageToNativeMapper)
+	mockedMessageToNativeMapper.On("Map", mock.MatchedBy(func(source []byte) bool { return true })).Return(NativeContent{Uuid: testArticleUUID, Type: compoundStory}, nil)
+	mockedImageSetMapper := new(mockImageSetMapper)
+	mockedImageSetMapper.On("Map", mock.MatchedBy(func(source NativeContent) bool { return true })).Return([]JSONImageSet{JSONImageSet{UUID: "512c1f3d-e48c-4618-863c-94bc9d913b9b"}}, nil)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	return newQueue(nil, mockedProducer, mockedMessageToNativeMapper, mockedImageSetMapper)
+}
+
+func TestOnMessage_NormalisesTimestamp(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	q := newTimestampTestQueue(mockedProducer)
+	err := q.onMessage(consumer.Message{Headers: map[string]string{
+		"X-Request-Id":      "tid_test123",
+		"Origin-System-Id":  methodeSystemOrigin,
+		"Message-Timestamp": "1494863672166",
+	}})
+	assert.NoError(t, err)
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 1)
+	msg := mockedProducer.Calls[0].Arguments.Get(1).(producer.Message)
+	assert.Equal(t, "2017-05-15T15:54:32.166Z", msg.Headers["Message-Timestamp"])
+	assert.Contains(t, msg.Body, `"lastModified":"2017-05-15T15:54:32.166Z"`)
+}
+
+func TestOnMessage_ReplacesInvalidTimestamp(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	q := newTimestampTestQueue(mockedProducer)
+	err := q.onMessage(consumer.Message{Headers: map[string]string{
+		"X-Request-Id":      "tid_test123",
+		"Origin-System-Id":  methodeSystemOrigin,
+		"Message-Timestamp": "yesterday",
+	}})
+	assert.NoError(t, err)
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 1)
+	msg := mockedProducer.Calls[0].Arguments.Get(1).(producer.Message)
+	replaced, err := normaliseTimestamp(msg.Headers["Message-Timestamp"])
+	assert.NoError(t, err, "The invalid timestamp should be replaced with a valid one")
+	assert.Equal(t, msg.Headers["Message-Timestamp"], replaced)
+}
+
+func TestOnMessage_CreatesMissingTimestamp(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	q := newTimestampTestQueue(mockedProducer)
+	err := q.onMessage(consumer.Message{Headers: map[string]string{
+		"X-Request-Id":     "tid_test123",
+		"Origin-System-Id": methodeSystemOrigin,
+	}})
+	assert.NoError(t, err)
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 1)
+	msg := mockedProducer.Calls[0].Arguments.Get(1).(producer.Message)
+	created, err := time.Parse(uppDateFormat, msg.Headers["Message-Timestamp"])
+	assert.NoError(t, err, "The created timestamp should be in the UPP format")
+	assert.True(t, strings.HasSuffix(msg.Headers["Message-Timestamp"], "Z"), "The created timestamp should be in UTC")
+	assert.WithinDuration(t, time.Now(), created, time.Minute)
+}
+
+func TestOnMessage_RejectsInvalidTimestamp(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	q := newTimestampTestQueue(mockedProducer)
+	q.invalidTimestampPolicy = rejectInvalidTimestamps
+	err := q.onMessage(consumer.Message{Headers: map[string]string{
+		"X-Request-Id":      "tid_test123",
+		"Origin-System-Id":  methodeSystemOrigin,
+		"Message-Timestamp": "yesterday",
+	}})
+	assert.NoError(t, err, "A rejected message shouldn't be consumed again")
+	mockedProducer.AssertNotCalled(t, "SendMessage", mock.Anything, mock.Anything)
+}
+
+func articleMessage(timestamp string, headers map[string]string) consumer.Message {
+	m := consumer.Message{Headers: map[string]string{
+		"X-Request-Id":      "tid_test123",
+		"Origin-System-Id":  methodeSystemOrigin,
+		"Message-Timestamp": timestamp,
+	}}
+	for name, value := range headers {
+		m.Headers[name] = value
+	}
+	return m
+}
+
+func TestOnMessage_SkipsStaleVersion(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	q := newTimestampTestQueue(mockedProducer)
+	q.articleVersions = newArticleVersions(10)
+	skipped := testutil.ToFloat64(staleArticlesSkipped)
+
+	assert.NoError(t, q.onMessage(articleMessage("2017-05-15T15:54:32.166Z", nil)))
+	assert.NoError(t, q.onMessage(articleMessage("2017-05-15T15:54:32.165Z", nil)), "A stale message shouldn't be consumed again")
+	assert.NoError(t, q.onMessage(articleMessage("2017-05-15T15:54:32.166Z", nil)), "The same version consumed again is published again")
+
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 2)
+	assert.Equal(t, skipped+1, testutil.ToFloat64(staleArticlesSkipped))
+}
+
+func TestOnMessage_DoesntRememberMadeUpVersions(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	q := newTimestampTestQueue(mockedProducer)
+	q.articleVersions = newArticleVersions(10)
+
+	assert.NoError(t, q.onMessage(articleMessage("", nil)))
+	assert.NoError(t, q.onMessage(articleMessage("yesterday", nil)))
+	assert.NoError(t, q.onMessage(articleMessage("2017-05-15T15:54:32.166Z", nil)), "A real version shouldn't be stale next to a made up one")
+	assert.NoError(t, q.onMessage(articleMessage("", nil)), "A made up version shouldn't be compared with a real one")
+
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 4)
+	stale, _ := q.articleVersions.isStale(testArticleUUID, time.Date(2017, 5, 15, 15, 54, 32, 165000000, time.UTC))
+	assert.True(t, stale, "The real version should be the latest one remembered")
+}
+
+func TestOnMessage_PublishesStaleVersionWhenForced(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	q := newTimestampTestQueue(mockedProducer)
+	q.articleVersions = newArticleVersions(10)
+
+	assert.NoError(t, q.onMessage(articleMessage("2017-05-15T15:54:32.166Z", nil)))
+	assert.NoError(t, q.onMessage(articleMessage("2017-05-14T15:54:32.166Z", map[string]string{"X-Force-Publish": "true"})))
+
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 2)
+	stale, latest := q.articleVersions.isStale(testArticleUUID, time.Date(2017, 5, 15, 0, 0, 0, 0, time.UTC))
+	assert.True(t, stale, "A forced older version shouldn't replace the latest one")
+	assert.Equal(t, "2017-05-15T15:54:32.166Z", latest.Format(uppDateFormat))
+}
+
+func TestOnMessage_DoesNotRememberFailedPublication(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(errors.New("couldn't send")).Once()
+	q := newTimestampTestQueue(mockedProducer)
+	q.articleVersions = newArticleVersions(10)
+
+	assert.Error(t, q.onMessage(articleMessage("2017-05-15T15:54:32.166Z", nil)))
+	assert.NoError(t, q.onMessage(articleMessage("2017-05-14T15:54:32.166Z", nil)))
+
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 2)
 }
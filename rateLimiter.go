@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/Financial-Times/message-queue-go-producer/producer"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitedProducer waits for a token of a shared bucket before every send, so that the messages of all the
+// producers sharing the limiter don't go out faster than its rate. The time spent waiting is added to throttled.
+type rateLimitedProducer struct {
+	producer.MessageProducer
+	limiter   *rate.Limiter
+	throttled prometheus.Counter
+}
+
+// newSendLimiter returns a token bucket allowing messagesPerSecond sends, with bursts of up to burst sends.
+// A rate of 0 or less doesn't limit at all.
+func newSendLimiter(messagesPerSecond int, burst int) *rate.Limiter {
+	if messagesPerSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(messagesPerSecond), burst)
+}
+
+func newRateLimitedProducer(messageProducer producer.MessageProducer, limiter *rate.Limiter, throttled prometheus.Counter) producer.MessageProducer {
+	if messageProducer == nil {
+		return nil
+	}
+	return &rateLimitedProducer{MessageProducer: messageProducer, limiter: limiter, throttled: throttled}
+}
+
+func (p *rateLimitedProducer) SendMessage(key string, msg producer.Message) error {
+	start := time.Now()
+	err := p.limiter.Wait(context.Background())
+	if err != nil {
+		return err
+	}
+	p.throttled.Add(time.Since(start).Seconds())
+	return p.MessageProducer.SendMessage(key, msg)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/message-queue-go-producer/producer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRateLimitedProducer_LimitsRateAcrossProducers(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	limiter := newSendLimiter(50, 2)
+	throttled := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_send_throttled_seconds_total"})
+	imageSets := newRateLimitedProducer(mockedProducer, limiter, throttled)
+	relations := newRateLimitedProducer(mockedProducer, limiter, throttled)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		imageSets.SendMessage("", producer.Message{})
+		relations.SendMessage("", producer.Message{})
+	}
+	elapsed := time.Since(start)
+
+	mockedProducer.AssertNumberOfCalls(t, "SendMessage", 8)
+	assert.True(t, elapsed >= 110*time.Millisecond, "After a burst of 2, six more sends at 50 per second should take at least 120ms, took %v", elapsed)
+	recorded := time.Duration(testutil.ToFloat64(throttled) * float64(time.Second))
+	assert.True(t, recorded >= 100*time.Millisecond, "Time spent throttled should be recorded, recorded %v", recorded)
+}
+
+func TestRateLimitedProducer_NoLimit(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(nil)
+	unlimited := newRateLimitedProducer(mockedProducer, newSendLimiter(0, 0), sendThrottledSeconds.WithLabelValues(serviceLimiter))
+
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, unlimited.SendMessage("", producer.Message{}))
+	}
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+}
+
+func TestRateLimitedProducer_NilProducer(t *testing.T) {
+	assert.Nil(t, newRateLimitedProducer(nil, newSendLimiter(10, 1), sendThrottledSeconds.WithLabelValues(serviceLimiter)))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Financial-Times/message-queue-go-producer/producer"
+	"github.com/Financial-Times/message-queue-gonsumer/consumer"
+	trans "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/Sirupsen/logrus"
+	"github.com/jawher/mow.cli"
+)
+
+const maxReplayLineSize = 16 * 1024 * 1024
+
+// replayCommand maps native articles from files instead of the queue, for backfills. Without --send the publication
+// messages are only printed, one JSON document per line.
+func (a *app) replayCommand(cmd *cli.Cmd) {
+	cmd.Spec = "[--send] [--rate] [--burst] PATH..."
+	send := cmd.Bool(cli.BoolOpt{
+		Name:  "send",
+		Value: false,
+		Desc:  "Send the publication messages to the queue configured for the service instead of printing them.",
+	})
+	rate := cmd.Int(cli.IntOpt{
+		Name:   "rate",
+		Value:  10,
+		Desc:   "Most messages to send per second, 0 for no limit. Replays aren't limited by publish-rate.",
+		EnvVar: "REPLAY_RATE",
+	})
+	burst := cmd.Int(cli.IntOpt{
+		Name:   "burst",
+		Value:  1,
+		Desc:   "Most messages to send at once when the rate allows it.",
+		EnvVar: "REPLAY_BURST",
+	})
+	paths := cmd.Strings(cli.StringsArg{
+		Name: "PATH",
+		Desc: "Native article files (.json), JSON lines files (.jsonl, .ndjson), directories holding them, or - to read JSON lines from stdin.",
+	})
+	cmd.Action = func() {
+		var messageProducer, relationsProducer producer.MessageProducer
+		if *send {
+			a.validateQueueArgs()
+			clients := a.newQueueClients()
+			defer clients.close()
+			messageProducer, relationsProducer = clients.messageProducer, clients.relationsProducer
+		} else {
+			messageProducer = newPrintingProducer(os.Stdout, a.args.writeTopic)
+			if a.args.relationsTopic != "" {
+				relationsProducer = newPrintingProducer(os.Stdout, a.args.relationsTopic)
+			}
+		}
+		r := a.newReplayer(messageProducer, relationsProducer, *rate, *burst)
+		for _, path := range *paths {
+			r.replayPath(path, os.Stdin)
+		}
+		summary := r.summary()
+		logEvent(replayEvent, "").WithFields(logrus.Fields{
+			"articles":          summary.articles,
+			"failed_articles":   summary.failedArticles,
+			"unreadable_inputs": summary.unreadableInputs,
+			"sent_messages":     summary.sentMessages,
+			"failed_messages":   summary.failedMessages,
+		}).Info("Replay finished.")
+		if summary.failedArticles != 0 || summary.unreadableInputs != 0 {
+			cli.Exit(1)
+		}
+	}
+}
+
+type replaySummary struct {
+	articles         int
+	failedArticles   int
+	unreadableInputs int
+	sentMessages     int
+	failedMessages   int
+}
+
+// replayer publishes native articles through the queue like consumed ones, each with its own lastModified as the
+// message timestamp. It keeps its own counts instead of the metrics of consumed messages.
+type replayer struct {
+	queue    *defaultQueue
+	origin   string
+	producer *replayProducer
+
+	articles         int
+	failedArticles   int
+	unreadableInputs int
+}
+
+// newReplayer returns a replayer whose sends share their own limiter, apart from the one of the service.
+func (a *app) newReplayer(messageProducer producer.MessageProducer, relationsProducer producer.MessageProducer, messagesPerSecond int, burst int) *replayer {
+	limiter := newSendLimiter(messagesPerSecond, burst)
+	throttled := sendThrottledSeconds.WithLabelValues(replayLimiter)
+	replayMessageProducer := &replayProducer{MessageProducer: newRateLimitedProducer(messageProducer, limiter, throttled)}
+	relationsProducer = newRateLimitedProducer(relationsProducer, limiter, throttled)
+	imageSetMapper := newImageSetMapper(defaultArticleToImageSetMapper{}, defaultAttributesMapper{}, defaultImageSetToJSONMapper{})
+	q := a.newConfiguredQueue(replayMessageProducer, relationsProducer, defaultMessageToNativeMapper{}, imageSetMapper)
+	return &replayer{queue: q, origin: q.acceptedOrigins[0], producer: replayMessageProducer}
+}
+
+func (r *replayer) summary() replaySummary {
+	return replaySummary{
+		articles:         r.articles,
+		failedArticles:   r.failedArticles,
+		unreadableInputs: r.unreadableInputs,
+		sentMessages:     r.producer.sent,
+		failedMessages:   r.producer.failed,
+	}
+}
+
+func (r *replayer) replayPath(path string, stdin io.Reader) {
+	if path == "-" {
+		r.replayLines("stdin", stdin)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		logEvent(replayEvent, "").WithField("path", path).WithError(err).Error("Couldn't read replay input.")
+		r.unreadableInputs++
+		return
+	}
+	if !info.IsDir() {
+		r.replayFile(path)
+		return
+	}
+	err = filepath.Walk(path, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			logEvent(replayEvent, "").WithField("path", filePath).WithError(err).Error("Couldn't read replay input.")
+			r.unreadableInputs++
+			return nil
+		}
+		if !fileInfo.IsDir() && isReplayFile(filePath) {
+			r.replayFile(filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		logEvent(replayEvent, "").WithField("path", path).WithError(err).Error("Couldn't walk replay input directory.")
+		r.unreadableInputs++
+	}
+}
+
+func isReplayFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".jsonl", ".ndjson":
+		return true
+	}
+	return false
+}
+
+func isJSONLinesFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".jsonl" || ext == ".ndjson"
+}
+
+func (r *replayer) replayFile(path string) {
+	if isJSONLinesFile(path) {
+		f, err := os.Open(path)
+		if err != nil {
+			logEvent(replayEvent, "").WithField("path", path).WithError(err).Error("Couldn't read replay input.")
+			r.unreadableInputs++
+			return
+		}
+		defer f.Close()
+		r.replayLines(path, f)
+		return
+	}
+	article, err := ioutil.ReadFile(path)
+	if err != nil {
+		logEvent(replayEvent, "").WithField("path", path).WithError(err).Error("Couldn't read replay input.")
+		r.unreadableInputs++
+		return
+	}
+	r.replayArticle(path, article)
+}
+
+func (r *replayer) replayLines(source string, reader io.Reader) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxReplayLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		article := strings.TrimSpace(scanner.Text())
+		if article == "" {
+			continue
+		}
+		r.replayArticle(fmt.Sprintf("%v:%v", source, line), []byte(article))
+	}
+	if err := scanner.Err(); err != nil {
+		logEvent(replayEvent, "").WithFields(logrus.Fields{"source": source, "line": line + 1}).WithError(err).Error("Couldn't read replay input.")
+		r.unreadableInputs++
+	}
+}
+
+// replayedArticle holds what a replay reads from a native article before mapping it.
+type replayedArticle struct {
+	LastModified string `json:"lastModified"`
+}
+
+// replayArticle publishes an article with its own last modified date as Message-Timestamp, so that replaying it
+// doesn't make it look newer than it is. Without one the date is made up and the article version isn't remembered.
+// Unlike the queue consumer, an article that couldn't be mapped counts as failed.
+func (r *replayer) replayArticle(source string, article []byte) {
+	r.articles++
+	tid := trans.NewTransactionID()
+	logEvent(replayEvent, tid).WithField("source", source).Info("Replaying article.")
+	headers := map[string]string{
+		"X-Request-Id":     tid,
+		"Origin-System-Id": r.origin,
+	}
+	var replayed replayedArticle
+	if err := json.Unmarshal(article, &replayed); err == nil && replayed.LastModified != "" {
+		headers["Message-Timestamp"] = replayed.LastModified
+	}
+	report, err := r.queue.publish(consumer.Message{Headers: headers, Body: string(article)}, false)
+	if err == nil && report.mappingErr != nil {
+		err = report.mappingErr
+	}
+	if err != nil {
+		logEvent(replayEvent, tid).WithField("source", source).WithError(err).Error("Couldn't replay article.")
+		r.failedArticles++
+	}
+}
+
+// replayProducer counts what was sent by a replay.
+type replayProducer struct {
+	producer.MessageProducer
+	sent   int
+	failed int
+}
+
+func (p *replayProducer) SendMessage(key string, msg producer.Message) error {
+	err := p.MessageProducer.SendMessage(key, msg)
+	if err != nil {
+		p.failed++
+		return err
+	}
+	p.sent++
+	return nil
+}
+
+// printingProducer writes messages as JSON lines instead of sending them.
+type printingProducer struct {
+	sync.Mutex
+	encoder *json.Encoder
+	topic   string
+}
+
+type printedMessage struct {
+	Topic   string            `json:"topic"`
+	Key     string            `json:"key,omitempty"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+func newPrintingProducer(w io.Writer, topic string) *printingProducer {
+	return &printingProducer{encoder: json.NewEncoder(w), topic: topic}
+}
+
+func (p *printingProducer) SendMessage(key string, msg producer.Message) error {
+	p.Lock()
+	defer p.Unlock()
+	return p.encoder.Encode(printedMessage{Topic: p.topic, Key: key, Headers: msg.Headers, Body: json.RawMessage(msg.Body)})
+}
+
+func (p *printingProducer) ConnectivityCheck() (string, error) {
+	return "Messages are printed, not sent.", nil
+}
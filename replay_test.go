@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Financial-Times/message-queue-go-producer/producer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const sampleArticleFile = "sample-methode-native-article-c17e8abe-1df8-11e7-942c-4a4c42b3072e.json"
+
+func newTestReplayer(messageProducer producer.MessageProducer, relationsProducer producer.MessageProducer) *replayer {
+	a := &app{args: args{outputOriginSystemID: methodeSystemOrigin}}
+	return a.newReplayer(messageProducer, relationsProducer, 0, 0)
+}
+
+func writeReplayInputs(t *testing.T, dir string) {
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	compact := new(bytes.Buffer)
+	assert.NoError(t, json.Compact(compact, article))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a-article.json"), article, 0644))
+	lines := compact.String() + "\n\n" + `{"uuid":"not json` + "\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b-articles.jsonl"), []byte(lines), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "c-notes.txt"), []byte("not an article"), 0644))
+}
+
+func TestReplay_PrintsMessagesFromDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeReplayInputs(t, dir)
+
+	out := new(bytes.Buffer)
+	r := newTestReplayer(newPrintingProducer(out, "CmsPublicationEvents"), newPrintingProducer(out, "ArticleImageSetRelations"))
+	r.replayPath(dir, nil)
+
+	printed := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, printed, 6, "Two image-sets and one relations message for each readable article")
+	var first printedMessage
+	assert.NoError(t, json.Unmarshal([]byte(printed[0]), &first))
+	assert.Equal(t, "CmsPublicationEvents", first.Topic)
+	assert.Equal(t, "cms-content-published", first.Headers["Message-Type"])
+	assert.Equal(t, "2017-05-02T14:36:59.078Z", first.Headers["Message-Timestamp"], "The article's own last modified date should be kept")
+	assert.Contains(t, string(first.Body), `"contentUri":"http://methode-article-image-set-mapper.svc.ft.com/image-set/model/`)
+	var relations printedMessage
+	assert.NoError(t, json.Unmarshal([]byte(printed[2]), &relations))
+	assert.Equal(t, "ArticleImageSetRelations", relations.Topic)
+	assert.Equal(t, "c17e8abe-1df8-11e7-942c-4a4c42b3072e", relations.Key)
+
+	summary := r.summary()
+	assert.Equal(t, 3, summary.articles, "The unreadable JSON line still counts as an article")
+	assert.Equal(t, 1, summary.failedArticles, "The unreadable JSON line couldn't be mapped")
+	assert.Equal(t, 0, summary.unreadableInputs)
+	assert.Equal(t, 4, summary.sentMessages)
+}
+
+func TestReplay_ReadsJSONLinesFromStdin(t *testing.T) {
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	compact := new(bytes.Buffer)
+	assert.NoError(t, json.Compact(compact, article))
+
+	out := new(bytes.Buffer)
+	r := newTestReplayer(newPrintingProducer(out, "CmsPublicationEvents"), nil)
+	r.replayPath("-", strings.NewReader(compact.String()+"\n"+compact.String()+"\n"))
+
+	assert.Equal(t, 2, r.summary().articles)
+	assert.Equal(t, 4, r.summary().sentMessages)
+	assert.Equal(t, 4, strings.Count(out.String(), "\n"))
+}
+
+func TestReplay_CountsFailedSendsAndMissingInputs(t *testing.T) {
+	mockedProducer := new(mockProducer)
+	mockedProducer.On("SendMessage", "", mock.MatchedBy(func(msg producer.Message) bool { return true })).Return(errors.New("couldn't send"))
+	r := newTestReplayer(mockedProducer, nil)
+
+	r.replayPath(sampleArticleFile, nil)
+	r.replayPath("does-not-exist.json", nil)
+
+	summary := r.summary()
+	assert.Equal(t, 1, summary.articles)
+	assert.Equal(t, 1, summary.failedArticles)
+	assert.Equal(t, 1, summary.unreadableInputs)
+	assert.Equal(t, 0, summary.sentMessages)
+	assert.Equal(t, 2, summary.failedMessages)
+}
@@ -1,45 +1,100 @@
 package main
 
 import (
+	"context"
+	"net"
 	"net/http"
 
 	status "github.com/Financial-Times/service-status-go/httphandlers"
-	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type routing struct {
-	httpMappingHandler HTTPMappingHandler
-	healthCheck        *HealthCheck
-	router             *mux.Router
+	httpMappingHandler  HTTPMappingHandler
+	batchMappingHandler *batchMappingHandler
+	validationHandler   *validationHandler
+	diffHandler         *diffHandler
+	lookupHandler       *imageSetLookupHandler
+	publishHandler      *publishHandler
+	dryRunMessages      *dryRunMessages
+	healthCheck         *HealthCheck
+	router              *mux.Router
+	server              *http.Server
 }
 
-func newRouting(httpMappingHandler HTTPMappingHandler, healthCheck *HealthCheck) routing {
-	r := routing{
-		httpMappingHandler: httpMappingHandler,
-		healthCheck:        healthCheck,
-		router:             mux.NewRouter(),
+// newRouting routes the endpoints, validating the requests against the OpenAPI document first. The lookup endpoints
+// are only routed when there's a lookupHandler, /publish when there's a publishHandler and the dry-run messages with
+// dry-run.
+func newRouting(httpMappingHandler HTTPMappingHandler, batchMappingHandler *batchMappingHandler, validationHandler *validationHandler, diffHandler *diffHandler,
+	lookupHandler *imageSetLookupHandler, publishHandler *publishHandler, dryRunMessages *dryRunMessages, healthCheck *HealthCheck) *routing {
+	r := &routing{
+		httpMappingHandler:  httpMappingHandler,
+		batchMappingHandler: batchMappingHandler,
+		validationHandler:   validationHandler,
+		diffHandler:         diffHandler,
+		lookupHandler:       lookupHandler,
+		publishHandler:      publishHandler,
+		dryRunMessages:      dryRunMessages,
+		healthCheck:         healthCheck,
+		router:              mux.NewRouter(),
 	}
+	api, err := parseOpenAPI(openAPIDocument)
+	if err != nil {
+		logEvent(serviceEvent, "").WithError(err).Fatal("Couldn't read the OpenAPI document.")
+	}
+	r.server = &http.Server{Handler: newRequestValidator(api, r.router)}
 	r.routeProductionEndpoints()
 	r.routeAdminEndpoints()
 	return r
 }
 
-func (r routing) routeProductionEndpoints() {
+func (r *routing) routeProductionEndpoints() {
 	r.router.Path("/map").Handler(handlers.MethodHandler{"POST": http.HandlerFunc(r.httpMappingHandler.handle)})
+	r.router.Path("/map/batch").Handler(handlers.MethodHandler{"POST": http.HandlerFunc(r.batchMappingHandler.handle)})
+	r.router.Path("/validate").Handler(handlers.MethodHandler{"POST": http.HandlerFunc(r.validationHandler.handle)})
+	r.router.Path("/diff").Handler(handlers.MethodHandler{"POST": http.HandlerFunc(r.diffHandler.handle)})
+	if r.lookupHandler != nil {
+		r.router.Path("/image-sets/{uuid}").Handler(handlers.MethodHandler{"GET": http.HandlerFunc(r.lookupHandler.getImageSet)})
+		r.router.Path("/image-sets/{uuid}/origin").Handler(handlers.MethodHandler{"GET": http.HandlerFunc(r.lookupHandler.getImageSetOrigin)})
+		r.router.Path("/articles/{uuid}/image-sets").Handler(handlers.MethodHandler{"GET": http.HandlerFunc(r.lookupHandler.getArticleImageSets)})
+	}
+	if r.publishHandler != nil {
+		r.router.Path("/publish").Handler(handlers.MethodHandler{"POST": http.HandlerFunc(r.publishHandler.handle)})
+	}
 }
 
-func (r routing) routeAdminEndpoints() {
+func (r *routing) routeAdminEndpoints() {
 	r.router.Path(healthPath).Handler(handlers.MethodHandler{"GET": http.HandlerFunc(r.healthCheck.Health())})
 	r.router.Path(status.GTGPath).Handler(handlers.MethodHandler{"GET": http.HandlerFunc(status.NewGoodToGoHandler(r.healthCheck.GTG))})
 	r.router.Path(status.BuildInfoPath).Handler(handlers.MethodHandler{"GET": http.HandlerFunc(status.BuildInfoHandler)})
 	r.router.Path(status.PingPath).HandlerFunc(status.PingHandler)
+	r.router.Path(prometheusMetricsPath).Handler(handlers.MethodHandler{"GET": promhttp.Handler()})
+	r.router.Path(apiPath).Handler(handlers.MethodHandler{"GET": http.HandlerFunc(serveOpenAPIDocument)})
+	logLevel := logLevelHandler{}
+	r.router.Path(logLevelPath).Handler(handlers.MethodHandler{"GET": http.HandlerFunc(logLevel.get), "PUT": http.HandlerFunc(logLevel.set)})
+	if r.dryRunMessages != nil {
+		r.router.Path(dryRunPath).Handler(handlers.MethodHandler{"GET": http.HandlerFunc(r.dryRunMessages.handle)})
+	}
 }
 
-func (r routing) listenAndServe(port string) {
-	err := http.ListenAndServe(":"+port, r.router)
+func (r *routing) listenAndServe(port string) {
+	listener, err := net.Listen("tcp", ":"+port)
 	if err != nil {
-		logrus.Fatalf("Couldn't serve http endpoints. %v\n", err)
+		logEvent(serviceEvent, "").WithError(err).Fatal("Couldn't serve http endpoints.")
 	}
+	r.serve(listener)
+}
+
+func (r *routing) serve(listener net.Listener) {
+	err := r.server.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
+		logEvent(serviceEvent, "").WithError(err).Fatal("Couldn't serve http endpoints.")
+	}
+}
+
+// shutdown stops accepting connections and waits for the open requests to finish, or until ctx is done.
+func (r *routing) shutdown(ctx context.Context) error {
+	return r.server.Shutdown(ctx)
 }
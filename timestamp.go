@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	replaceInvalidTimestamps = "replace"
+	rejectInvalidTimestamps  = "reject"
+)
+
+// timestampFormats are the layouts Message-Timestamp headers come in, besides epoch milliseconds.
+var timestampFormats = []string{uppDateFormat, time.RFC3339Nano}
+
+// normaliseTimestamp parses a Message-Timestamp in any of the formats seen upstream and formats it in UTC with
+// uppDateFormat, which is what downstream validation expects.
+func normaliseTimestamp(value string) (string, error) {
+	for _, format := range timestampFormats {
+		t, err := time.Parse(format, value)
+		if err == nil {
+			return t.UTC().Format(uppDateFormat), nil
+		}
+	}
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err == nil && millis > 0 {
+		return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format(uppDateFormat), nil
+	}
+	return "", fmt.Errorf("Message-Timestamp %q is neither %v, RFC3339 nor epoch milliseconds", value, uppDateFormat)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormaliseTimestamp(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"2017-05-15T15:54:32.166Z", "2017-05-15T15:54:32.166Z"},
+		{"2017-05-15T16:54:32.166+0100", "2017-05-15T15:54:32.166Z"},
+		{"2017-05-15T15:54:32Z", "2017-05-15T15:54:32.000Z"},
+		{"2017-05-15T17:54:32.166432+02:00", "2017-05-15T15:54:32.166Z"},
+		{"1494863672166", "2017-05-15T15:54:32.166Z"},
+	}
+	for _, test := range tests {
+		actual, err := normaliseTimestamp(test.value)
+		assert.NoError(t, err, "Timestamp %v should be valid", test.value)
+		assert.Equal(t, test.expected, actual, "Timestamp %v", test.value)
+	}
+}
+
+func TestNormaliseTimestamp_Invalid(t *testing.T) {
+	for _, value := range []string{"yesterday", "15/05/2017 15:54", "2017-05-15", "-1494863672166", "0"} {
+		_, err := normaliseTimestamp(value)
+		assert.Error(t, err, "Timestamp %v should be invalid", value)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	trans "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/Sirupsen/logrus"
+)
+
+// validationHandler maps a native article like /map, but answers with what's wrong with it instead of failing.
+type validationHandler struct {
+	defaultHTTPMappingHandler
+	diagnosingMapper DiagnosingImageSetMapper
+}
+
+// validationResult is valid when no diagnostic is an error. The image-sets are the ones that would be published.
+type validationResult struct {
+	UUID        string              `json:"uuid,omitempty"`
+	Valid       bool                `json:"valid"`
+	ImageSets   []JSONImageSet      `json:"imageSets"`
+	Diagnostics []MappingDiagnostic `json:"diagnostics"`
+}
+
+func newValidationHandler(messageToNativeMapper MessageToNativeMapper, imageSetMapper DiagnosingImageSetMapper) *validationHandler {
+	return &validationHandler{
+		defaultHTTPMappingHandler: defaultHTTPMappingHandler{messageToNativeMapper: messageToNativeMapper, imageSetMapper: imageSetMapper},
+		diagnosingMapper:          imageSetMapper,
+	}
+}
+
+func (h *validationHandler) handle(w http.ResponseWriter, r *http.Request) {
+	tid := trans.GetTransactionIDFromRequest(r)
+	w.Header().Add("Content-Type", "application/json;charset=utf-8")
+	w.Header().Add(trans.TransactionIDHeader, tid)
+
+	body, err := ioutil.ReadAll(r.Body)
+	defer closeRequestBody(r)
+	if err != nil {
+		writeError(w, newInternalError(requestStage, fmt.Errorf("Cound't read from request body. %v", err)), tid)
+		return
+	}
+
+	result := h.validate(body, tid)
+	logEvent(requestEvent, tid).WithFields(logrus.Fields{uuidField: result.UUID, "valid": result.Valid, "diagnostics": len(result.Diagnostics)}).Info("Validated article.")
+	marshaledResult, err := json.Marshal(result)
+	if err != nil {
+		writeError(w, newInternalError(responseStage, fmt.Errorf("Couldn't marshall validation result to JSON. %v", err)), tid)
+		return
+	}
+	_, err = w.Write(marshaledResult)
+	if err != nil {
+		logEvent(requestEvent, tid).WithError(err).Warn("Couldn't write to response.")
+	}
+}
+
+func (h *validationHandler) validate(body []byte, tid string) validationResult {
+	result := validationResult{ImageSets: []JSONImageSet{}, Diagnostics: []MappingDiagnostic{}}
+	native, err := h.messageToNativeMapper.Map(body)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, newErrorDiagnostic(newMappingError(invalidNativeJSONCode, nativeStage, "", err)))
+		return result
+	}
+	result.UUID = native.Uuid
+	imageSets, diagnostics, err := h.diagnosingMapper.MapWithDiagnostics(native, time.Now().UTC().Format(uppDateFormat), tid)
+	if err == nil {
+		result.ImageSets = imageSets
+	}
+	result.Diagnostics = append(result.Diagnostics, diagnostics...)
+	result.Valid = !hasErrors(result.Diagnostics)
+	return result
+}
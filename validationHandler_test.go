@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postValidate(t *testing.T, body []byte) validationResult {
+	imageSetMapper := newImageSetMapper(defaultArticleToImageSetMapper{}, defaultAttributesMapper{}, defaultImageSetToJSONMapper{})
+	h := newValidationHandler(defaultMessageToNativeMapper{}, imageSetMapper)
+	request, err := http.NewRequest("POST", "/validate", bytes.NewReader(body))
+	assert.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(h.handle).ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var result validationResult
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	return result
+}
+
+func TestValidate_ValidArticle(t *testing.T) {
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	result := postValidate(t, article)
+	assert.True(t, result.Valid)
+	assert.Equal(t, "c17e8abe-1df8-11e7-942c-4a4c42b3072e", result.UUID)
+	assert.Len(t, result.ImageSets, 2)
+}
+
+func TestValidate_WarnsAboutMembersLeftOut(t *testing.T) {
+	article, err := ioutil.ReadFile(sampleArticleFile)
+	assert.NoError(t, err)
+	var native NativeContent
+	assert.NoError(t, json.Unmarshal(article, &native))
+	value, err := base64.StdEncoding.DecodeString(native.Value)
+	assert.NoError(t, err)
+	value = bytes.Replace(value, []byte("artboards-s.png?uuid="), []byte("artboards-s.png?id="), 1)
+	native.Value = base64.StdEncoding.EncodeToString(value)
+	article, err = json.Marshal(native)
+	assert.NoError(t, err)
+
+	result := postValidate(t, article)
+
+	assert.True(t, result.Valid, "Members left out are only warnings")
+	assert.Len(t, result.ImageSets, 2)
+	assert.Len(t, result.Diagnostics, 1)
+	assert.Equal(t, "MEMBER_WITHOUT_UUID", result.Diagnostics[0].Code)
+	assert.Equal(t, "warning", result.Diagnostics[0].Severity)
+	assert.NotEmpty(t, result.Diagnostics[0].ImageSetID)
+	assert.NotEmpty(t, result.Diagnostics[0].Member)
+}
+
+func TestValidate_ReportsErrors(t *testing.T) {
+	result := postValidate(t, []byte(`{"uuid":"c17e8abe-1df8-11e7-942c-4a4c42b3072e","value":"not base64"}`))
+	assert.False(t, result.Valid)
+	assert.Equal(t, "c17e8abe-1df8-11e7-942c-4a4c42b3072e", result.UUID)
+	assert.Empty(t, result.ImageSets)
+	assert.Equal(t, []MappingDiagnostic{{Code: "BAD_BASE64", Severity: "error", Stage: "body", Field: "value", Message: result.Diagnostics[0].Message}}, result.Diagnostics)
+
+	result = postValidate(t, []byte(`not json`))
+	assert.False(t, result.Valid)
+	assert.Equal(t, "NATIVE_JSON_INVALID", result.Diagnostics[0].Code)
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"github.com/Financial-Times/uuid-utils-go"
-	"github.com/Sirupsen/logrus"
 	"strings"
 	"time"
 )
@@ -17,27 +16,36 @@ const (
 )
 
 type XMLImageSetToJSONMapper interface {
-	Map(xmlImageSets []XMLImageSet, articleUuid string, attributes xmlAttributes, lastModified string, publishReference string) ([]JSONImageSet, error)
+	Map(xmlImageSets []XMLImageSet, articleUuid string, attributes xmlAttributes, lastModified string, publishReference string) ([]JSONImageSet, []MappingDiagnostic, error)
 }
 
 type defaultImageSetToJSONMapper struct{}
 
-func (m defaultImageSetToJSONMapper) Map(xmlImageSets []XMLImageSet, articleUuid string, attributes xmlAttributes, lastModified string, publishReference string) ([]JSONImageSet, error) {
+// Map returns the image-sets with the warnings about members left out of them.
+func (m defaultImageSetToJSONMapper) Map(xmlImageSets []XMLImageSet, articleUuid string, attributes xmlAttributes, lastModified string, publishReference string) ([]JSONImageSet, []MappingDiagnostic, error) {
 	jsonImageSets := make([]JSONImageSet, 0)
+	diagnostics := make([]MappingDiagnostic, 0)
 	for _, xmlImageSet := range xmlImageSets {
 		members := make([]JSONMember, 0, 3)
-		m.appendIfPresent(&members, xmlImageSet.ImageMedium, "medium", "", "")
-		m.appendIfPresent(&members, xmlImageSet.ImageSmall, "small", "490px", "")
-		m.appendIfPresent(&members, xmlImageSet.ImageLarge, "large", "", "980px")
+		for _, diagnostic := range []*MappingDiagnostic{
+			m.appendIfPresent(&members, xmlImageSet.ImageMedium, "medium", "", ""),
+			m.appendIfPresent(&members, xmlImageSet.ImageSmall, "small", "490px", ""),
+			m.appendIfPresent(&members, xmlImageSet.ImageLarge, "large", "", "980px"),
+		} {
+			if diagnostic != nil {
+				diagnostic.ImageSetID = xmlImageSet.ID
+				diagnostics = append(diagnostics, *diagnostic)
+			}
+		}
 
 		uuid := uuidutils.NewV3UUID(articleUuid + xmlImageSet.ID)
-		publishedDate, err := time.Parse(methodeDateFormat, attributes.OutputChannels.DIFTcom.DIFTcomLastPublication)
+		publishedDate, err := parseMethodeDate(attributes.OutputChannels.DIFTcom.DIFTcomLastPublication, "published date", "DIFTcomLastPublication", xmlImageSet.ID)
 		if err != nil {
-			return nil, fmt.Errorf("Couldn't parse required methode field published date (DIFTcomLastPublication) %v %v", attributes.OutputChannels.DIFTcom.DIFTcomLastPublication, err)
+			return nil, diagnostics, err
 		}
-		firstPublishedDate, err := time.Parse(methodeDateFormat, attributes.OutputChannels.DIFTcom.DIFTcomInitialPublication)
+		firstPublishedDate, err := parseMethodeDate(attributes.OutputChannels.DIFTcom.DIFTcomInitialPublication, "initial published date", "DIFTcomInitialPublication", xmlImageSet.ID)
 		if err != nil {
-			return nil, fmt.Errorf("Couldn't parse required methode field initial published date (DIFTcomInitialPublication) %v %v", attributes.OutputChannels.DIFTcom.DIFTcomInitialPublication, err)
+			return nil, diagnostics, err
 		}
 		jsonImageSet := JSONImageSet{
 			UUID:    uuid.String(),
@@ -54,34 +62,61 @@ func (m defaultImageSetToJSONMapper) Map(xmlImageSets []XMLImageSet, articleUuid
 			LastModified:       lastModified,
 			PublishReference:   publishReference,
 			Type:               imageSetType,
+			MethodeID:          xmlImageSet.ID,
 		}
 		jsonImageSets = append(jsonImageSets, jsonImageSet)
 	}
-	return jsonImageSets, nil
+	return jsonImageSets, diagnostics, nil
+}
+
+// parseMethodeDate parses a required date of the attributes, failing with DATE_MISSING when it's empty.
+func parseMethodeDate(value string, name string, field string, imageSetID string) (time.Time, error) {
+	if strings.TrimSpace(value) == "" {
+		err := newMappingError(dateMissingCode, attributesStage, field, fmt.Errorf("Couldn't find required methode field %v (%v)", name, field))
+		err.imageSetID = imageSetID
+		return time.Time{}, err
+	}
+	date, err := time.Parse(methodeDateFormat, value)
+	if err != nil {
+		mappingErr := newMappingError(dateInvalidCode, attributesStage, field, fmt.Errorf("Couldn't parse required methode field %v (%v) %v %v", name, field, value, err))
+		mappingErr.imageSetID = imageSetID
+		return time.Time{}, mappingErr
+	}
+	return date, nil
 }
 
-func (m defaultImageSetToJSONMapper) appendIfPresent(members *[]JSONMember, xmlImage XMLImage, memberName string, maxDisplayWidth string, minDisplayWidth string) {
-	jsonMember := m.mapMember(xmlImage, memberName, maxDisplayWidth, minDisplayWidth)
-	if jsonMember == nil {
-		logrus.Warn("")
-	} else {
+// appendIfPresent appends the member when it can be mapped, or returns why it was left out.
+func (m defaultImageSetToJSONMapper) appendIfPresent(members *[]JSONMember, xmlImage XMLImage, memberName string, maxDisplayWidth string, minDisplayWidth string) *MappingDiagnostic {
+	jsonMember, diagnostic := m.mapMember(xmlImage, memberName, maxDisplayWidth, minDisplayWidth)
+	if jsonMember != nil {
 		*members = append(*members, *jsonMember)
 	}
+	return diagnostic
 }
 
-func (m defaultImageSetToJSONMapper) mapMember(xmlImage XMLImage, memberName string, maxDisplayWidth string, minDisplayWidth string) *JSONMember {
+func (m defaultImageSetToJSONMapper) mapMember(xmlImage XMLImage, memberName string, maxDisplayWidth string, minDisplayWidth string) (*JSONMember, *MappingDiagnostic) {
 	if xmlImage.FileRef == "" {
-		logrus.Warnf("expected member %v is not present.", memberName)
-		return nil
+		return nil, &MappingDiagnostic{
+			Code:     memberMissingCode,
+			Severity: warningSeverity,
+			Stage:    imageSetStage,
+			Member:   memberName,
+			Message:  fmt.Sprintf("expected member %v is not present.", memberName),
+		}
 	}
 	refs := strings.Split(xmlImage.FileRef, "?uuid=")
 	if len(refs) != 2 {
-		logrus.Warnf("at member %v fileref attribute doesn't contain uuid fileref=%v", memberName, xmlImage.FileRef)
-		return nil
+		return nil, &MappingDiagnostic{
+			Code:     memberWithoutUUIDCode,
+			Severity: warningSeverity,
+			Stage:    imageSetStage,
+			Member:   memberName,
+			Message:  fmt.Sprintf("at member %v fileref attribute doesn't contain uuid fileref=%v", memberName, xmlImage.FileRef),
+		}
 	}
 	return &JSONMember{
 		UUID:            strings.Split(xmlImage.FileRef, "?uuid=")[1],
 		MaxDisplayWidth: maxDisplayWidth,
 		MinDisplayWidth: minDisplayWidth,
-	}
+	}, nil
 }
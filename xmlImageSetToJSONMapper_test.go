@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/stretchr/testify/assert"
+	"net/http"
 	"testing"
 )
 
@@ -42,7 +43,7 @@ func TestXMLJSONMap_Ok(t *testing.T) {
 			},
 		},
 	}
-	actualImageSets, err := m.Map(source, uuid, xmlAttributes, "2017-05-17T13:46:01.100Z", "tid_test")
+	actualImageSets, _, err := m.Map(source, uuid, xmlAttributes, "2017-05-17T13:46:01.100Z", "tid_test")
 	if err != nil {
 		assert.Error(t, err, "error mapping set")
 	}
@@ -74,6 +75,7 @@ func TestXMLJSONMap_Ok(t *testing.T) {
 			FirstPublishedDate: "2017-05-18T13:24:00.000Z",
 			CanBeDistributed:   "yes",
 			Type:               "ImageSet",
+			MethodeID:          "U11603547146784PeC",
 		},
 		JSONImageSet{
 			UUID: "84be18d3-4622-3bb1-87b6-33786f12902f",
@@ -102,6 +104,7 @@ func TestXMLJSONMap_Ok(t *testing.T) {
 			FirstPublishedDate: "2017-05-18T13:24:00.000Z",
 			CanBeDistributed:   "yes",
 			Type:               "ImageSet",
+			MethodeID:          "U12345547146784RfD",
 		},
 	}
 	assert.Equal(t, expectedImageSets, actualImageSets)
@@ -126,7 +129,7 @@ func TestXMLJSONMap_LessThan3(t *testing.T) {
 			},
 		},
 	}
-	actualImageSets, err := m.Map(source, uuid, xmlAttributes, "2017-05-17T13:46:01.100Z", "tid_test")
+	actualImageSets, diagnostics, err := m.Map(source, uuid, xmlAttributes, "2017-05-17T13:46:01.100Z", "tid_test")
 	if err != nil {
 		assert.Error(t, err, "error mapping set")
 	}
@@ -151,28 +154,65 @@ func TestXMLJSONMap_LessThan3(t *testing.T) {
 			FirstPublishedDate: "2017-05-18T02:24:00.000Z",
 			CanBeDistributed:   "yes",
 			Type:               "ImageSet",
+			MethodeID:          "U11603547146784PeC",
 		},
 	}
 	assert.Equal(t, expectedImageSets, actualImageSets)
+	assert.Equal(t, []MappingDiagnostic{
+		{Code: "MEMBER_MISSING", Severity: "warning", Stage: "image-set", ImageSetID: "U11603547146784PeC", Member: "medium", Message: "expected member medium is not present."},
+		{Code: "MEMBER_MISSING", Severity: "warning", Stage: "image-set", ImageSetID: "U11603547146784PeC", Member: "large", Message: "expected member large is not present."},
+	}, diagnostics)
+}
+
+func TestXMLJSONMap_DateErrors(t *testing.T) {
+	m := defaultImageSetToJSONMapper{}
+	source := []XMLImageSet{{ID: "U11603547146784PeC"}}
+	tests := []struct {
+		lastPublication    string
+		initialPublication string
+		expectedCode       string
+		expectedField      string
+	}{
+		{"", "20170518022400", dateMissingCode, "DIFTcomLastPublication"},
+		{"20170518022425", "yesterday", dateInvalidCode, "DIFTcomInitialPublication"},
+	}
+	for _, test := range tests {
+		attributes := xmlAttributes{OutputChannels: OutputChannels{DIFTcom{
+			DIFTcomLastPublication:    test.lastPublication,
+			DIFTcomInitialPublication: test.initialPublication,
+		}}}
+		_, _, err := m.Map(source, "c17e8abe-1df8-11e7-942c-4a4c42b3072e", attributes, "2017-05-17T13:46:01.100Z", "tid_test")
+		mappingErr, ok := err.(*mappingError)
+		assert.True(t, ok, "The error should be a mappingError")
+		assert.Equal(t, test.expectedCode, mappingErr.code)
+		assert.Equal(t, attributesStage, mappingErr.stage)
+		assert.Equal(t, test.expectedField, mappingErr.field)
+		assert.Equal(t, "U11603547146784PeC", mappingErr.imageSetID)
+		assert.Equal(t, http.StatusUnprocessableEntity, mappingErr.status())
+	}
 }
 
 func TestAppendIfPresent_Present(t *testing.T) {
 	mapper := defaultImageSetToJSONMapper{}
 	members := make([]JSONMember, 0)
-	mapper.appendIfPresent(&members, XMLImage{FileRef: "/FT/Graphics/Online/Z_Undefined/2017/03/timeline-artboards-s.png?uuid=4258f26a-13c5-11e7-9469-afea892e4de3"}, "any", "", "980px")
+	diagnostic := mapper.appendIfPresent(&members, XMLImage{FileRef: "/FT/Graphics/Online/Z_Undefined/2017/03/timeline-artboards-s.png?uuid=4258f26a-13c5-11e7-9469-afea892e4de3"}, "any", "", "980px")
+	assert.Nil(t, diagnostic)
 	assert.Contains(t, members, JSONMember{UUID: "4258f26a-13c5-11e7-9469-afea892e4de3", MinDisplayWidth: "980px"})
 }
 
 func TestAppendIfPresent_NoUuid(t *testing.T) {
 	mapper := defaultImageSetToJSONMapper{}
 	members := make([]JSONMember, 0)
-	mapper.appendIfPresent(&members, XMLImage{FileRef: "/FT/Graphics/Online/Z_Undefined/2017/03/timeline-artboards-s.png"}, "any", "", "980px")
+	diagnostic := mapper.appendIfPresent(&members, XMLImage{FileRef: "/FT/Graphics/Online/Z_Undefined/2017/03/timeline-artboards-s.png"}, "any", "", "980px")
 	assert.Equal(t, len(members), 0)
+	assert.Equal(t, "MEMBER_WITHOUT_UUID", diagnostic.Code)
+	assert.Equal(t, "any", diagnostic.Member)
 }
 
 func TestAppendIfPresent_NoEntry(t *testing.T) {
 	mapper := defaultImageSetToJSONMapper{}
 	members := make([]JSONMember, 0)
-	mapper.appendIfPresent(&members, XMLImage{}, "any", "", "980px")
+	diagnostic := mapper.appendIfPresent(&members, XMLImage{}, "any", "", "980px")
 	assert.Equal(t, len(members), 0)
+	assert.Equal(t, "MEMBER_MISSING", diagnostic.Code)
 }